@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/howels/infra-tools/scaleio"
+	"github.com/howels/infra-tools/ssh"
+)
+
+//testdata is the directory of captured scli output the fake MDMs answer queries with
+var testdata = flag.String("testdata", "scaleio/testdata", "directory of captured scli output")
+
+//check is one case of the suite, a non-nil error fails it
+type check struct {
+	name string
+	run  func() error
+}
+
+func main() {
+	flag.Parse()
+
+	checks := []check{
+		{"cluster login moves on to the next MDM and refreshes from it", func() error {
+			down := sshclient.NewFakeShell()
+			down.On("--login").Exit(1).ReturnStderr("Error: MDM failed command.  Status: Could not connect to MDM")
+			up := fakeMDM()
+			mdm1, mdm2 := mdmNode(down, "mdm1", "11"), mdmNode(up, "mdm2", "12")
+			cluster := &scaleio.Cluster{MDMs: []*scaleio.MDMNode{mdm1, mdm2}, ScaleIO: sio(2)}
+			if err := cluster.Refresh(); err != nil {
+				return err
+			}
+			if cluster.MDMs[0] != mdm2 {
+				return fmt.Errorf("expected mdm2 first after its login, got %v", cluster.MDMs[0].Hostname)
+			}
+			if cluster.State.Mode != scaleio.Mode3Node || !cluster.IsCluster || len(cluster.SDSInfo) == 0 || len(cluster.Volumes) == 0 || len(cluster.Pools) == 0 {
+				return fmt.Errorf("unexpected refreshed state %+v", cluster.State)
+			}
+			return expectCommands(up, "--login", "--query_cluster", "--query_all\\b", "--query_storage_pool", "--query_all_sds", "--query_all_volumes")
+		}},
+		{"MDM node creates the cluster with its data and management IPs", func() error {
+			f := sshclient.NewFakeShell()
+			f.On("--create_mdm_cluster").Return("Successfully created the MDM Cluster.")
+			cluster, err := sio(1).NewCluster(mdmNode(f, "mdm1", "11"))
+			if err != nil {
+				return err
+			}
+			if cluster.IsCluster {
+				return fmt.Errorf("a new cluster should start in single node mode")
+			}
+			return expectCommands(f, "--mdm_ip=10\\.0\\.0\\.11 --create_mdm_cluster --master_mdm_ip 10\\.0\\.0\\.11 --master_mdm_management_ip 192\\.168\\.0\\.11 --master_mdm_name mdm1")
+		}},
+		{"password change logs in again with the new password", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			var logins []string
+			f.On("--login").Run(func(cmd *sshclient.Command, stdin string) (string, string, int) {
+				logins = append(logins, strings.TrimSpace(stdin))
+				return "Logged in", "", 0
+			})
+			f.On("--set_password").Return("Password changed successfully")
+			cluster := &scaleio.Cluster{MDMs: []*scaleio.MDMNode{mdmNode(f, "mdm1", "11")}, ScaleIO: sio(1)}
+			if err := cluster.SetPassword("NewSIOPass456"); err != nil {
+				return err
+			}
+			if len(logins) != 2 || logins[0] != "SIOPass123" || logins[1] != "NewSIOPass456" || cluster.ScaleIO.Password != "NewSIOPass456" {
+				return fmt.Errorf("expected a login with the old and then the new password, got %q", logins)
+			}
+			return nil
+		}},
+		{"an SDS registered in another fault set is not reused", func() error {
+			f := fakeMDM()
+			f.On("--query_sds").Return(capture("query_sds"))
+			cluster := &scaleio.Cluster{MDMs: []*scaleio.MDMNode{mdmNode(f, "mdm1", "11")}, ScaleIO: sio(1)}
+			sds := &scaleio.SDSNode{Node: &scaleio.Node{SSH: f, Hostname: "sds1"}, ProtectionDomain: "pd1", FaultSet: "rack2"}
+			_, err := cluster.AddSDS(sds)
+			if err == nil || !strings.Contains(err.Error(), "fault set rack1, not rack2") {
+				return fmt.Errorf("expected an error for the fault set, got %v", err)
+			}
+			return expectNoCommand(f, "--add_sds")
+		}},
+		{"cluster grows from a single node to 3_node and 5_node mode", func() error {
+			f := modeMDM("query_cluster_single", "query_cluster_3_node", "query_cluster_3_node", "query_cluster_5_node")
+			cluster := modeCluster(f)
+			if err := cluster.SwitchMode(scaleio.Mode3Node); err != nil {
+				return err
+			}
+			if err := cluster.SwitchMode(scaleio.Mode5Node); err != nil {
+				return err
+			}
+			if cluster.State.Mode != scaleio.Mode5Node || !cluster.IsCluster {
+				return fmt.Errorf("expected 5_node mode, got %v", cluster.State.Mode)
+			}
+			if err := expectNoCommand(f, "--new_mdm_name mdm3"); err != nil {
+				return fmt.Errorf("the standby manager mdm3 should not be registered again: %v", err)
+			}
+			return expectCommands(f,
+				"--add_standby_mdm --new_mdm_ip 10\\.0\\.0\\.12 --mdm_role manager --new_mdm_name mdm2 --new_mdm_management_ip 192\\.168\\.0\\.12",
+				"--add_standby_mdm --new_mdm_ip 10\\.0\\.0\\.13 --mdm_role tb --new_mdm_name tb1'",
+				"--switch_to_cluster_mode",
+				"--switch_cluster_mode --cluster_mode 3_node --add_slave_mdm_name mdm2 --add_tb_name tb1'",
+				"--add_standby_mdm --new_mdm_ip 10\\.0\\.0\\.15 --mdm_role tb --new_mdm_name tb2'",
+				"--switch_cluster_mode --cluster_mode 5_node --add_slave_mdm_name mdm3 --add_tb_name tb2'")
+		}},
+		{"cluster shrinks from 5_node to 3_node and single node mode", func() error {
+			f := modeMDM("query_cluster_5_node", "query_cluster_3_node", "query_cluster_3_node", "query_cluster_single")
+			cluster := modeCluster(f)
+			if err := cluster.SwitchMode(scaleio.Mode3Node); err != nil {
+				return err
+			}
+			if err := cluster.SwitchMode(scaleio.ModeSingleNode); err != nil {
+				return err
+			}
+			if cluster.IsCluster || cluster.MDMs[0].Hostname != "mdm1" {
+				return fmt.Errorf("expected a single node cluster on mdm1, got %v on %v", cluster.State.Mode, cluster.MDMs[0].Hostname)
+			}
+			if err := expectCommands(f,
+				"--switch_cluster_mode --cluster_mode 3_node --remove_slave_mdm_name mdm3 --remove_tb_name tb2'",
+				"--switch_cluster_mode --cluster_mode 1_node --remove_slave_mdm_name mdm2 --remove_tb_name tb1'"); err != nil {
+				return err
+			}
+			return expectNoCommand(f, "--add_standby_mdm|--switch_to_cluster_mode")
+		}},
+		{"a standby tie-breaker is not made a slave MDM", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("--login").Return("Logged in")
+			f.On("--query_cluster").Return(strings.Replace(capture("query_cluster_3_node"), "0x2b4e6a8c0d1f3e52, Manager", "0x2b4e6a8c0d1f3e52, Tie Breaker", 1))
+			cluster := modeCluster(f)
+			err := cluster.SwitchMode(scaleio.Mode5Node)
+			if err == nil || !strings.Contains(err.Error(), "manager nodes") {
+				return fmt.Errorf("expected too few manager nodes, got %v", err)
+			}
+			return expectNoCommand(f, "--switch_cluster_mode")
+		}},
+		{"install without packages runs every command and gathers no facts", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("prereq|erase|install").Return("")
+			if err := installNode(f).Install(); err != nil {
+				return err
+			}
+			if err := expectCommands(f, "echo prereq", "echo erase", "echo install"); err != nil {
+				return err
+			}
+			return expectNoCommand(f, "uname")
+		}},
+		{"install skips the erase and install commands when the packages are installed", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("uname -s").Return("Linux\n")
+			f.On("## uname").Return(capture("facts_linux"))
+			f.On("prereq").Return("")
+			if err := installNode(f, "EMC-ScaleIO-sds", "EMC-ScaleIO-lia").Install(); err != nil {
+				return err
+			}
+			if err := expectCommands(f, "uname -s", "## uname", "echo prereq"); err != nil {
+				return err
+			}
+			return expectNoCommand(f, "echo erase|echo install")
+		}},
+		{"install runs every command when facts cannot be gathered", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("uname -s").Exit(127).ReturnStderr("bash: uname: command not found")
+			f.On("prereq|erase|install").Return("")
+			if err := installNode(f, "EMC-ScaleIO-sds").Install(); err != nil {
+				return err
+			}
+			return expectCommands(f, "uname -s", "echo prereq", "echo erase", "echo install")
+		}},
+		{"install refuses ESXi hosts", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("uname -s").Return("VMkernel\n")
+			f.On("## uname").Return(capture("facts_esxi"))
+			if err := installNode(f, "EMC-ScaleIO-sds").Install(); err == nil || !strings.Contains(err.Error(), "need Linux") {
+				return fmt.Errorf("expected an error for an ESXi host, got %v", err)
+			}
+			return expectNoCommand(f, "prereq")
+		}},
+		{"SDS install skips the install commands when its packages are installed", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("uname -s").Return("Linux\n")
+			f.On("## uname").Return(capture("facts_linux"))
+			f.On("prereq").Return("")
+			sds := &scaleio.SDSNode{Node: installNode(f, "EMC-ScaleIO-sds", "EMC-ScaleIO-lia")}
+			if err := sds.Install(); err != nil {
+				return err
+			}
+			if err := expectCommands(f, "uname -s", "echo prereq"); err != nil {
+				return err
+			}
+			return expectNoCommand(f, "echo erase|echo install")
+		}},
+		{"ESXi facts are gathered once for concurrent callers", func() error {
+			f := sshclient.NewFakeShell()
+			f.Strict = true
+			f.On("uname -s").Return("VMkernel\n")
+			f.On("## uname").Return(capture("facts_esxi"))
+			sdc := &scaleio.SDCESXi{SSH: f, Hostname: "esx1"}
+			errs := make(chan error, 4)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					_, err := sdc.Facts(context.Background())
+					errs <- err
+				}()
+			}
+			for i := 0; i < cap(errs); i++ {
+				if err := <-errs; err != nil {
+					return err
+				}
+			}
+			if commands := f.Commands(); len(commands) != 2 {
+				return fmt.Errorf("expected the facts to be gathered once, ran:\n%v", strings.Join(commands, "\n"))
+			}
+			return nil
+		}},
+		{"local shell timeout stops the processes the command started", func() error {
+			grace := sshclient.KillGrace
+			sshclient.KillGrace = 200 * time.Millisecond
+			defer func() { sshclient.KillGrace = grace }()
+			start := time.Now()
+			_, err := sshclient.NewLocalShell().Execute(&sshclient.Command{Command: "sleep 5; echo done", Timeout: 300 * time.Millisecond, OnStdout: func(string, string) {}})
+			if _, ok := err.(*sshclient.TimeoutError); !ok {
+				return fmt.Errorf("expected *sshclient.TimeoutError, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				return fmt.Errorf("command was stopped only after %v", elapsed)
+			}
+			return nil
+		}},
+		{"local shell returns when a background process keeps the output open", func() error {
+			grace := sshclient.KillGrace
+			sshclient.KillGrace = 200 * time.Millisecond
+			defer func() { sshclient.KillGrace = grace }()
+			start := time.Now()
+			out, err := sshclient.NewLocalShell().Execute(&sshclient.Command{Command: "sleep 5 & echo started", OnStdout: func(string, string) {}})
+			if err != nil || out.Stdout != "started\n" {
+				return fmt.Errorf("expected the command to succeed, got %v %q", err, out.Stdout)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				return fmt.Errorf("command returned only after %v", elapsed)
+			}
+			return nil
+		}},
+		{"SDC on ESXi sets the scini GUID and MDM IPs and reloads the module", func() error {
+			f := sshclient.NewFakeShell()
+			f.On("esxcli system module parameters set").Return("")
+			f.On("vmkload_mod").Return("")
+			sdc := &scaleio.SDCESXi{SSH: f, Hostname: "esx1"}
+			if err := sdc.UpdateScini("", "guid-1"); err == nil || len(f.Commands()) > 0 {
+				return fmt.Errorf("expected an error and no commands without MDM IPs, got %v %v", err, f.Commands())
+			}
+			if err := sdc.UpdateScini("10.0.0.11,10.0.0.12", "guid-1"); err != nil {
+				return err
+			}
+			if flags := sdc.SDCFlags(); strings.Join(flags, " ") != "--sdc_guid guid-1" {
+				return fmt.Errorf("unexpected SDC flags %v", flags)
+			}
+			return expectCommands(f, "-m scini -p 'IoctlIniGuidStr=guid-1 IoctlMdmIPStr=10\\.0\\.0\\.11,10\\.0\\.0\\.12'", "vmkload_mod -u scini;esxcli system module load -m scini")
+		}},
+		//last, as it registers admin as a secret for the rest of the run
+		{"short passwords such as the default admin are masked in logs and transcripts", func() error {
+			f := fakeMDM()
+			cluster := &scaleio.Cluster{MDMs: []*scaleio.MDMNode{mdmNode(f, "mdm1", "11")}, ScaleIO: &scaleio.ScaleIO{Password: "admin", MaxRetries: 1}}
+			if err := cluster.Refresh(); err != nil {
+				return err
+			}
+			for _, out := range f.Transcript() {
+				if strings.Contains(out.Command+out.Stdin+out.Stdout+out.Stderr, "admin") {
+					return fmt.Errorf("the password admin shows in the transcript of %q", out.Command)
+				}
+			}
+			if err := expectCommands(f, "--login"); err != nil {
+				return err
+			}
+			if masked := sshclient.Redact("--password admin"); masked != "--password "+sshclient.Redacted {
+				return fmt.Errorf("expected the registered password admin to be masked, got %q", masked)
+			}
+			return nil
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			failed++
+			log.Printf("FAIL %v: %v", c.name, err)
+			continue
+		}
+		log.Printf("ok   %v", c.name)
+	}
+	if failed > 0 {
+		log.Printf("%v of %v checks failed", failed, len(checks))
+		os.Exit(1)
+	}
+	log.Printf("All %v checks passed", len(checks))
+}
+
+//sio is the ScaleIO environment of the checks, retrying logins without waiting
+func sio(attempts int) *scaleio.ScaleIO {
+	return &scaleio.ScaleIO{Password: "SIOPass123", Retry: sshclient.RetryPolicy{Attempts: attempts, Backoff: time.Millisecond}}
+}
+
+//mdmNode is an MDM on the fake shell with data IP 10.0.0.<ip> and management IP 192.168.0.<ip>
+func mdmNode(f *sshclient.FakeShell, name string, ip string) *scaleio.MDMNode {
+	return &scaleio.MDMNode{Node: &scaleio.Node{SSH: f, Hostname: name, DataNetworks: []string{"10.0.0." + ip + "/24"}, ManagementNetwork: "192.168.0." + ip + "/24"}}
+}
+
+//fakeMDM accepts logins and answers the Refresh queries from the captured scli output
+func fakeMDM() *sshclient.FakeShell {
+	f := sshclient.NewFakeShell()
+	f.Strict = true
+	f.On("--login").Return("Logged in. User role is SuperUser. System ID is 4a2a37ff0e4e1b2c")
+	f.On("--query_cluster").Return(capture("query_cluster_3_node"))
+	f.On("--query_all_sds").Return(capture("query_all_sds"))
+	f.On("--query_all_volumes").Return(capture("query_all_volumes"))
+	f.On("--query_all\\b").Return(capture("query_all"))
+	f.On("--query_storage_pool").Return(capture("query_storage_pool"))
+	return f
+}
+
+func capture(name string) string {
+	output, err := ioutil.ReadFile(filepath.Join(*testdata, name+".txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(output)
+}
+
+//modeMDM accepts logins and mode changes and answers each --query_cluster with the next capture
+func modeMDM(states ...string) *sshclient.FakeShell {
+	f := sshclient.NewFakeShell()
+	f.Strict = true
+	f.On("--login").Return("Logged in. User role is SuperUser. System ID is 4a2a37ff0e4e1b2c")
+	for _, state := range states {
+		f.On("--query_cluster").Once().Return(capture(state))
+	}
+	f.On("--add_standby_mdm").Return("Successfully added a standby MDM.")
+	f.On("--switch_to_cluster_mode|--switch_cluster_mode").Return("Successfully switched the cluster mode.")
+	return f
+}
+
+//modeCluster has the MDMs and TBs of the captured clusters: mdm1, mdm2 and mdm3 on .11, .12 and .14, tb1 and tb2 on .13 and .15
+func modeCluster(f *sshclient.FakeShell) *scaleio.Cluster {
+	tb := func(name string, ip string) *scaleio.TBNode {
+		return &scaleio.TBNode{Node: mdmNode(f, name, ip).Node}
+	}
+	return &scaleio.Cluster{
+		MDMs:    []*scaleio.MDMNode{mdmNode(f, "mdm1", "11"), mdmNode(f, "mdm2", "12"), mdmNode(f, "mdm3", "14")},
+		TBs:     []*scaleio.TBNode{tb("tb1", "13"), tb("tb2", "15")},
+		ScaleIO: sio(1),
+	}
+}
+
+//installNode is a node with one prereq, erase and install command that provide the packages
+func installNode(f *sshclient.FakeShell, packages ...string) *scaleio.Node {
+	node := &scaleio.Node{SSH: f, Hostname: "node1"}
+	node.Installation.PrereqCommands = []string{"echo prereq"}
+	node.Installation.EraseCommands = []string{"echo erase"}
+	node.Installation.InstallCommands = []string{"echo install"}
+	node.Installation.Packages = packages
+	return node
+}
+
+//expectNoCommand checks the fake shell ran no command matching the pattern
+func expectNoCommand(f *sshclient.FakeShell, pattern string) error {
+	re := regexp.MustCompile(pattern)
+	for _, command := range f.Commands() {
+		if re.MatchString(command) {
+			return fmt.Errorf("unexpected command %q", command)
+		}
+	}
+	return nil
+}
+
+//expectCommands checks the fake shell ran commands matching the patterns, in that order
+func expectCommands(f *sshclient.FakeShell, patterns ...string) error {
+	commands := f.Commands()
+	i := 0
+	for _, pattern := range patterns {
+		re := regexp.MustCompile(pattern)
+		for i < len(commands) && !re.MatchString(commands[i]) {
+			i++
+		}
+		if i == len(commands) {
+			return fmt.Errorf("no command matching %q in order, ran:\n%v", pattern, strings.Join(commands, "\n"))
+		}
+		i++
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package scaleio
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/howels/infra-tools/ssh"
 )
@@ -16,16 +17,25 @@ type Cluster struct {
 	ScaleIO   *ScaleIO
 	IsCluster bool
 	Options   *clusterOptions
+	Context   context.Context //bounds every scli command, defaults to context.Background()
+
+	//populated by Refresh from scli queries
+	State             *ClusterState
+	SDSInfo           []SDSInfo
+	Volumes           []VolumeInfo
+	ProtectionDomains []ProtectionDomainInfo
+	Pools             []PoolInfo
 }
 
 type clusterOptions struct {
-	NumberMDM int
-	NumberTB  int
+	NumberMDM         int
+	NumberTB          int
+	SDSConnectTimeout time.Duration //how long AddSDS waits for a new SDS to connect to the MDM
 }
 
 //Defaults sets certain usual options
 func (cluster *Cluster) Defaults() {
-	cluster.Options = &clusterOptions{NumberMDM: 2, NumberTB: 1}
+	cluster.Options = &clusterOptions{NumberMDM: 2, NumberTB: 1, SDSConnectTimeout: 5 * time.Minute}
 }
 
 func (cluster *Cluster) mdmIP() string {
@@ -49,85 +59,133 @@ func (cluster *Cluster) scliIP() string {
 	return cluster.MDMs[0].MgmtIPString()
 }
 
-func (cluster *Cluster) command(cmd string) (*sshclient.CommandOutput, error) {
-	return cluster.MDMs[0].Command(cmd)
+func (cluster *Cluster) context() context.Context {
+	if cluster.Context == nil {
+		return context.Background()
+	}
+	return cluster.Context
 }
 
-func (cluster *Cluster) login() error {
-	login := false
-	retries := 0
-	var err error
-	var output *sshclient.CommandOutput
-	for login == false && retries < cluster.ScaleIO.MaxRetries {
-		retries = retries + 1
-		loginCommand := fmt.Sprintf("scli --mdm_ip=%v --login --username admin --password %v", cluster.mdmIP(), cluster.ScaleIO.Password)
-		output, err = cluster.command(loginCommand)
-		if err != nil {
-			cluster.MDMs = rotate(cluster.MDMs, 1)
-		}
-	}
-	if retries == cluster.ScaleIO.MaxRetries {
-		log.Printf("Login failed, maximum attempts used: %v", output.Stderr)
-		return err
-	}
-	log.Printf("Login success: %v", output.Stdout)
-	return nil
+//scli runs scli on the first MDM, every argument is quoted
+func (cluster *Cluster) scli(args ...string) (*sshclient.CommandOutput, error) {
+	return cluster.MDMs[0].scli(cluster.context(), args...)
 }
 
-func rotate(a []*MDMNode, i int) []*MDMNode {
-	x, b := (a)[:i], (a)[i:]
-	a = append(b, x...)
-	return a
+//scliSecret runs scli on the first MDM, the secret flag values are sent on stdin
+func (cluster *Cluster) scliSecret(flags []secretFlag, args ...string) (*sshclient.CommandOutput, error) {
+	return cluster.MDMs[0].scliSecret(cluster.context(), flags, args...)
 }
 
-func (cluster *Cluster) activateCluster() error {
-	if len(cluster.MDMs) < cluster.Options.NumberMDM {
-		log.Fatal(fmt.Sprintf("Need more MDM nodes (%v) to activate cluster, found only (%v)", cluster.Options.NumberMDM, len(cluster.MDMs)))
+//query runs a read-only scli command on the first MDM against the cluster's MDM IPs
+func (cluster *Cluster) query(args ...string) (string, error) {
+	return cluster.queryContext(cluster.context(), args...)
+}
+
+func (cluster *Cluster) queryContext(ctx context.Context, args ...string) (string, error) {
+	return cluster.MDMs[0].query(ctx, append([]string{"--mdm_ip=" + cluster.mdmIP()}, args...)...)
+}
+
+//Refresh logs in and reads the cluster mode, MDM roles, SDS states, protection domains, storage pools and volumes from scli
+func (cluster *Cluster) Refresh() error {
+	err := cluster.login()
+	if err != nil {
+		return err
 	}
-	if len(cluster.TBs) < cluster.Options.NumberTB {
-		log.Fatal(fmt.Sprintf("Need more TB nodes (%v)to activate cluster, found only (%v)", cluster.Options.NumberTB, len(cluster.TBs)))
+	state, err := cluster.queryCluster()
+	if err != nil {
+		return err
 	}
-	cluster.login()
-
-	_, err := cluster.command(fmt.Sprintf("scli --mdm_ip='%v' --switch_to_cluster_mode", cluster.mdmIP()))
+	domains, pools, err := cluster.storageTopology()
 	if err != nil {
 		return err
 	}
-	_, err = cluster.command(fmt.Sprintf("scli --mdm_ip=%v --switch_cluster_mode --cluster_mode 3_node --add_slave_mdm_name %v --add_tb_name %v", cluster.mdmIP(), cluster.MDMs[1].Hostname, cluster.TBs[0].Hostname))
+	output, err := cluster.query("--query_all_sds")
 	if err != nil {
 		return err
 	}
-	cluster.IsCluster = true
-	return nil
-}
-
-//SetPassword sets the ScaleIO password
-func (cluster *Cluster) SetPassword(password string) error {
-	_, err := cluster.command(fmt.Sprintf("scli --login --username admin --password %v", cluster.ScaleIO.Password))
+	sdss, err := ParseSDSList(output)
 	if err != nil {
 		return err
 	}
-	_, err = cluster.command(fmt.Sprintf("scli --set_password --old_password %v --new_password %v", cluster.ScaleIO.Password, password))
+	output, err = cluster.query("--query_all_volumes")
 	if err != nil {
 		return err
 	}
-	err = cluster.login()
+	volumes, err := ParseVolumes(output)
 	if err != nil {
 		return err
 	}
-	cluster.ScaleIO.Password = password
+	cluster.State, cluster.ProtectionDomains, cluster.Pools, cluster.SDSInfo, cluster.Volumes = state, domains, pools, sdss, volumes
+	cluster.IsCluster = state.Clustered()
 	return nil
 }
 
-//AddMDMStandby adds the other MDM node
-func (cluster *Cluster) AddMDMStandby(mdm MDMNode) error {
-	err := cluster.login()
+//queryCluster reads the cluster mode and MDM roles
+func (cluster *Cluster) queryCluster() (*ClusterState, error) {
+	output, err := cluster.query("--query_cluster")
+	if err != nil {
+		return nil, err
+	}
+	return ParseClusterState(output)
+}
+
+//loginPolicy is the ScaleIO retry policy with MaxRetries as the attempts if none are set
+func (cluster *Cluster) loginPolicy() sshclient.RetryPolicy {
+	policy := cluster.ScaleIO.Retry
+	if policy.Attempts == 0 {
+		policy.Attempts = cluster.ScaleIO.MaxRetries
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = func(err error) bool {
+			_, rejected := err.(*sshclient.ExitError)
+			return rejected || sshclient.Transient(err)
+		}
+	}
+	if policy.OnRetry == nil {
+		policy.OnRetry = func(attempt int, err error, wait time.Duration) {}
+	}
+	return policy
+}
+
+//login tries each MDM in turn under the login policy
+func (cluster *Cluster) login() error {
+	err := cluster.loginPolicy().Do(cluster.context(), func(ctx context.Context, attempt int) error {
+		output, err := cluster.scliSecret([]secretFlag{{"--password", cluster.ScaleIO.Password}}, "--mdm_ip="+cluster.mdmIP(), "--login", "--username", "admin")
+		if err == nil {
+			logf("Login success: %v", output.Stdout)
+			return nil
+		}
+		if exitErr, ok := err.(*sshclient.ExitError); ok {
+			logf("Login rejected by scli on %v (exit status %v): %v", cluster.MDMs[0].Hostname, exitErr.ExitStatus, output.Stderr)
+		} else {
+			logf("Unable to reach MDM %v: %v", cluster.MDMs[0].Hostname, err)
+		}
+		cluster.MDMs = rotate(cluster.MDMs, 1)
+		return err
+	})
+	if err != nil {
+		logf("Login failed: %v", err)
+	}
+	return err
+}
+
+func rotate(a []*MDMNode, i int) []*MDMNode {
+	x, b := (a)[:i], (a)[i:]
+	a = append(b, x...)
+	return a
+}
+
+//SetPassword sets the ScaleIO password
+func (cluster *Cluster) SetPassword(password string) error {
+	_, err := cluster.scliSecret([]secretFlag{{"--password", cluster.ScaleIO.Password}}, "--login", "--username", "admin")
 	if err != nil {
 		return err
 	}
-	_, err = cluster.command(fmt.Sprintf("scli --mdm_ip=%v --add_standby_mdm --new_mdm_ip %v --mdm_role manager --new_mdm_management_ip %v --new_mdm_name %v", cluster.mdmIP(), mdm.DataIPString(), mdm.DataIPString(), mdm.Hostname))
+	_, err = cluster.scliSecret([]secretFlag{{"--old_password", cluster.ScaleIO.Password}, {"--new_password", password}}, "--set_password")
 	if err != nil {
 		return err
 	}
-	return nil
+	//the old password no longer works, so the new one is kept before logging in again
+	cluster.ScaleIO.Password = password
+	return cluster.login()
 }
@@ -1,11 +1,13 @@
 package scaleio
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 
 	// yaml "gopkg.in/yaml.v2"
 	"github.com/ghodss/yaml"
+	"github.com/howels/infra-tools/ssh"
 )
 
 //BMC credentials
@@ -35,6 +37,43 @@ type Config struct {
 	Datacenter    string
 	VibURL        string `json:"vib_url"`
 	PackageURL    string `json:"package_url"`
+
+	Bastions       []Bastion `json:"bastions,omitempty"`
+	bastionClients []*sshclient.SSHClient
+
+	Topology Topology `json:"topology,omitempty"`
+}
+
+//Topology is the storage layout ApplyTopology creates once the cluster is up
+type Topology struct {
+	ProtectionDomains []ProtectionDomainConfig `json:"protection_domains"`
+}
+
+//ProtectionDomainConfig is a protection domain with its fault sets and storage pools
+type ProtectionDomainConfig struct {
+	Name         string              `json:"name"`
+	FaultSets    []string            `json:"fault_sets,omitempty"`
+	StoragePools []StoragePoolConfig `json:"storage_pools,omitempty"`
+}
+
+//StoragePoolConfig is a storage pool and its options, options left out keep the ScaleIO defaults
+type StoragePoolConfig struct {
+	Name         string `json:"name"`
+	SparePercent int    `json:"spare_percent,omitempty"` //capacity kept free for rebuilds, usually 100 divided by the number of SDS or fault sets
+	ZeroPadding  *bool  `json:"zero_padding,omitempty"`  //can only be changed while the pool has no devices
+	RMCache      *bool  `json:"rmcache,omitempty"`       //use the SDS RAM read cache
+	Checksum     *bool  `json:"checksum,omitempty"`
+}
+
+//Bastion is an SSH jump host in front of this environment's networks, listed in the order they are crossed
+type Bastion struct {
+	Host          string        `json:"host"`
+	Port          int           `json:"port,omitempty"`
+	User          string        `json:"user"`
+	Pass          string        `json:"pass,omitempty"`
+	KeyFile       string        `json:"key_file,omitempty"`
+	KeyPassphrase string        `json:"key_passphrase,omitempty"`
+	HostKey       HostKeyConfig `json:"host_key,omitempty"`
 }
 
 //ConfigVM carrries the location where an OVA is installed plus it's config parameters
@@ -85,7 +124,127 @@ type Host struct {
 	BMCPass   string   `json:"bmc_pass"`
 	Datastore string
 	Network   NetworkMap
-	SDS       SDSConfig `json:"sds"`
+	SDS       SDSConfig     `json:"sds"`
+	HostKey   HostKeyConfig `json:"host_key,omitempty"`
+	SSHPort   int           `json:"ssh_port,omitempty"`
+}
+
+//HostKeyConfig selects how the SSH host key of a host is verified.
+//Policy is one of known_hosts, fingerprint, tofu or insecure, known_hosts with ~/.ssh/known_hosts when left out.
+type HostKeyConfig struct {
+	Policy       string   `json:"policy"`
+	KnownHosts   []string `json:"known_hosts,omitempty"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+//SSHOptions converts the host key settings into options for the node constructors
+func (hk HostKeyConfig) SSHOptions() ([]sshclient.Option, error) {
+	switch sshclient.HostKeyPolicy(hk.Policy) {
+	case sshclient.HostKeyInsecure:
+		return []sshclient.Option{sshclient.WithInsecureHostKey()}, nil
+	case "", sshclient.HostKeyKnownHosts:
+		return []sshclient.Option{sshclient.WithKnownHosts(hk.KnownHosts...)}, nil
+	case sshclient.HostKeyFingerprint:
+		if len(hk.Fingerprints) == 0 {
+			return nil, fmt.Errorf("Host key policy 'fingerprint' needs at least one fingerprint")
+		}
+		return []sshclient.Option{sshclient.WithHostKeyFingerprints(hk.Fingerprints...)}, nil
+	case sshclient.HostKeyTrustOnFirstUse:
+		if len(hk.KnownHosts) != 1 {
+			return nil, fmt.Errorf("Host key policy 'tofu' needs exactly one known_hosts file")
+		}
+		return []sshclient.Option{sshclient.WithTrustOnFirstUse(hk.KnownHosts[0])}, nil
+	}
+	return nil, fmt.Errorf("Unknown host key policy: %v", hk.Policy)
+}
+
+//SSHOptions returns the SSH options configured for this host
+func (host Host) SSHOptions() ([]sshclient.Option, error) {
+	options, err := host.HostKey.SSHOptions()
+	if err != nil {
+		return nil, err
+	}
+	if host.SSHPort != 0 {
+		options = append(options, sshclient.WithPort(host.SSHPort))
+	}
+	return options, nil
+}
+
+//SSHOptions returns the options for reaching a host of this environment, through the bastions if any are declared
+func (config *Config) SSHOptions(host Host) ([]sshclient.Option, error) {
+	options, err := host.SSHOptions()
+	if err != nil {
+		return nil, err
+	}
+	return config.throughBastions(options)
+}
+
+//SSHClient connects to the ESXi host by hostname with its host key policy, port and the bastions, for SDCESXi.SSH
+func (config *Config) SSHClient(host Host, username string, password string) (*sshclient.SSHClient, error) {
+	options, err := config.SSHOptions(host)
+	if err != nil {
+		return nil, fmt.Errorf("Host %v: %v", host.Hostname, err)
+	}
+	return sshclient.NewSSHClient(username, password, host.Hostname, options...), nil
+}
+
+//SDSNode builds the node for the SDS VM of a host from its SIO-MGMT and SIO-DATA networks, verifying the VM's
+//host key as its sds host_key says and reaching it through the bastions
+func (config *Config) SDSNode(host Host, username string, password string, useSudo bool) (*SDSNode, error) {
+	network := host.SDS.Network
+	if network.SIOMGMT.IP == "" {
+		return nil, fmt.Errorf("SDS %v of host %v has no SIO-MGMT IP", host.SDS.VMName, host.Hostname)
+	}
+	var data []string
+	for _, n := range []Network{network.SIODATA1, network.SIODATA2} {
+		if n.IP != "" {
+			data = append(data, n.CIDR())
+		}
+	}
+	options, err := host.SDS.HostKey.SSHOptions()
+	if err != nil {
+		return nil, fmt.Errorf("SDS %v: %v", host.SDS.VMName, err)
+	}
+	options, err = config.throughBastions(options)
+	if err != nil {
+		return nil, err
+	}
+	return NewSDSNode(username, password, host.SDS.VMName, data, network.SIOMGMT.CIDR(), useSudo, options...), nil
+}
+
+//throughBastions adds the bastion chain to the options, if the environment declares one
+func (config *Config) throughBastions(options []sshclient.Option) ([]sshclient.Option, error) {
+	jumps, err := config.BastionClients()
+	if err != nil {
+		return nil, err
+	}
+	if len(jumps) > 0 {
+		options = append(options, sshclient.WithProxyJump(jumps...))
+	}
+	return options, nil
+}
+
+//BastionClients builds the jump host chain once so every node shares the bastion connections
+func (config *Config) BastionClients() ([]*sshclient.SSHClient, error) {
+	if config.bastionClients != nil || len(config.Bastions) == 0 {
+		return config.bastionClients, nil
+	}
+	var clients []*sshclient.SSHClient
+	for _, bastion := range config.Bastions {
+		options, err := bastion.HostKey.SSHOptions()
+		if err != nil {
+			return nil, fmt.Errorf("Bastion %v: %v", bastion.Host, err)
+		}
+		if bastion.Port != 0 {
+			options = append(options, sshclient.WithPort(bastion.Port))
+		}
+		if bastion.KeyFile != "" {
+			options = append(options, sshclient.WithPrivateKeyFile(bastion.KeyFile, bastion.KeyPassphrase))
+		}
+		clients = append(clients, sshclient.NewSSHClient(bastion.User, bastion.Pass, bastion.Host, options...))
+	}
+	config.bastionClients = clients
+	return clients, nil
 }
 
 //NetworkMap is a list of ScaleIO-specific networks
@@ -109,6 +268,11 @@ type Network struct {
 	VnicName string `json:"vnic_name,omitempty"`
 }
 
+//CIDR is the IP with the prefix length of its netmask, as the node constructors take it
+func (network Network) CIDR() string {
+	return network.IP + "/" + netmaskBits(network.Netmask)
+}
+
 //SDSConfig describes an SDS VM
 type SDSConfig struct {
 	VMName          string `json:"vm_name"`
@@ -116,6 +280,7 @@ type SDSConfig struct {
 		Nat string
 	} `json:"network_mappings"`
 	Network NetworkMap
+	HostKey HostKeyConfig `json:"host_key,omitempty"`
 }
 
 //Import takes the config file
@@ -0,0 +1,370 @@
+package scaleio
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/howels/infra-tools/ssh"
+)
+
+//OSFamily is the kind of host facts were gathered from
+type OSFamily string
+
+const (
+	//OSLinux is any Linux distribution, details are in Facts.Release
+	OSLinux OSFamily = "linux"
+	//OSESXi is a VMware ESXi host, queried with esxcli
+	OSESXi OSFamily = "esxi"
+)
+
+//Facts describes a host as found before installing ScaleIO on it
+type Facts struct {
+	OS       OSFamily
+	Release  Release
+	Kernel   string
+	Arch     string
+	CPUs     int
+	Memory   uint64            //bytes
+	Disks    []Disk            //whole disks only, partitions are left out
+	NICs     []NIC             //on ESXi the vmnics and the vmkernel interfaces that carry its IPs
+	Packages map[string]string //installed EMC-ScaleIO rpms or debs, or ScaleIO VIBs on ESXi, to their versions
+}
+
+//Release identifies the OS release, from /etc/os-release on Linux
+type Release struct {
+	ID      string //centos, rhel, sles, ubuntu, or esxi
+	Version string
+	Name    string //the human readable name and version
+}
+
+//Disk is a block device on the host
+type Disk struct {
+	Name string //sdb on Linux, the device identifier such as naa.5000c5008c0db1cb on ESXi
+	Size uint64 //bytes
+	SSD  bool
+}
+
+//NIC is a network interface with its addresses in CIDR form
+type NIC struct {
+	Name      string
+	MAC       string
+	MTU       int
+	Up        bool
+	Addresses []string
+}
+
+//quiet keeps fact gathering output off the console
+var quiet sshclient.LineHandler = func(prefix string, line string) {}
+
+//linuxFactsScript prints each source under a section marker, so all facts come back in one round trip.
+//Missing tools leave their section empty instead of failing the script.
+const linuxFactsScript = `echo '## uname'; uname -r -m
+echo '## os-release'; cat /etc/os-release 2>/dev/null
+echo '## nproc'; nproc 2>/dev/null
+echo '## meminfo'; cat /proc/meminfo 2>/dev/null
+echo '## lsblk'; lsblk -b -d -n -P -o NAME,SIZE,TYPE,ROTA 2>/dev/null
+echo '## link'; ip -o link show 2>/dev/null
+echo '## addr'; ip -o addr show 2>/dev/null
+echo '## packages'
+if command -v rpm >/dev/null; then rpm -qa --qf '%{NAME} %{VERSION}-%{RELEASE}\n' 'EMC-ScaleIO-*'
+elif command -v dpkg-query >/dev/null; then dpkg-query -W -f '${Package} ${Version}\n' 'emc-scaleio-*' 2>/dev/null
+fi
+true`
+
+//esxiFactsScript does the same with esxcli, whose CSV output has a header row naming the columns
+const esxiFactsScript = `echo '## uname'; uname -r -m
+echo '## version'; vmware -v
+echo '## cpu'; esxcli --formatter=csv hardware cpu global get
+echo '## memory'; esxcli --formatter=csv hardware memory get
+echo '## devices'; esxcli --formatter=csv storage core device list
+echo '## nics'; esxcli --formatter=csv network nic list
+echo '## vmknics'; esxcli --formatter=csv network ip interface list
+echo '## ipv4'; esxcli --formatter=csv network ip interface ipv4 get
+echo '## vibs'; esxcli --formatter=csv software vib list
+true`
+
+//GatherFacts finds out what kind of host the shell is connected to and collects its facts
+func GatherFacts(ctx context.Context, shell sshclient.ShellConnection) (*Facts, error) {
+	out, err := shell.ExecuteContext(ctx, &sshclient.Command{Command: "uname -s", OnStdout: quiet})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to identify host OS: %v", err)
+	}
+	script := linuxFactsScript
+	parse := ParseLinuxFacts
+	switch kernel := strings.TrimSpace(out.Stdout); kernel {
+	case "Linux":
+	case "VMkernel":
+		script = esxiFactsScript
+		parse = ParseESXiFacts
+	default:
+		return nil, fmt.Errorf("Unsupported host OS: %v", kernel)
+	}
+	out, err = shell.ExecuteContext(ctx, &sshclient.Command{Command: script, OnStdout: quiet})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to gather host facts: %v", err)
+	}
+	return parse(out.Stdout)
+}
+
+//ParseLinuxFacts reads the output of the Linux facts script
+func ParseLinuxFacts(output string) (*Facts, error) {
+	return parseLinuxFacts(splitSections(output))
+}
+
+//ParseESXiFacts reads the output of the ESXi facts script
+func ParseESXiFacts(output string) (*Facts, error) {
+	return parseESXiFacts(splitSections(output))
+}
+
+//Installed reports whether every named package is installed
+func (f *Facts) Installed(packages ...string) bool {
+	for _, name := range packages {
+		if _, ok := f.Packages[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//PackageManager is the command that installs OS packages, empty on ESXi
+func (f *Facts) PackageManager() string {
+	switch f.Release.ID {
+	case "ubuntu", "debian":
+		return "apt-get"
+	case "sles", "opensuse", "opensuse-leap":
+		return "zypper"
+	case "esxi":
+		return ""
+	}
+	return "yum"
+}
+
+//HasAddress reports whether any interface carries the IP
+func (f *Facts) HasAddress(ip string) bool {
+	for _, nic := range f.NICs {
+		for _, addr := range nic.Addresses {
+			if strings.SplitN(addr, "/", 2)[0] == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *Facts) String() string {
+	return fmt.Sprintf("%v %v (%v %v), %v CPUs, %v MiB, %v disks, %v NICs, %v ScaleIO packages",
+		f.Release.Name, f.Arch, f.OS, f.Kernel, f.CPUs, f.Memory>>20, len(f.Disks), len(f.NICs), len(f.Packages))
+}
+
+//splitSections maps each "## name" marker to the lines printed after it
+func splitSections(output string) map[string][]string {
+	sections := map[string][]string{}
+	var current string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "## ") {
+			current = strings.TrimPrefix(line, "## ")
+			sections[current] = nil
+			continue
+		}
+		if current != "" && strings.TrimSpace(line) != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+	return sections
+}
+
+func parseUname(facts *Facts, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) >= 1 {
+		facts.Kernel = fields[0]
+	}
+	if len(fields) >= 2 {
+		facts.Arch = fields[1]
+	}
+}
+
+func parseLinuxFacts(sections map[string][]string) (*Facts, error) {
+	facts := &Facts{OS: OSLinux, Packages: map[string]string{}}
+	parseUname(facts, sections["uname"])
+	if facts.Kernel == "" {
+		return nil, fmt.Errorf("Unable to gather host facts: no kernel version in output")
+	}
+	release := keyValues(sections["os-release"], "=")
+	facts.Release = Release{ID: release["ID"], Version: release["VERSION_ID"], Name: release["PRETTY_NAME"]}
+	if lines := sections["nproc"]; len(lines) > 0 {
+		facts.CPUs, _ = strconv.Atoi(strings.TrimSpace(lines[0]))
+	}
+	if fields := strings.Fields(keyValues(sections["meminfo"], ":")["MemTotal"]); len(fields) > 0 {
+		kb, _ := strconv.ParseUint(fields[0], 10, 64)
+		facts.Memory = kb * 1024
+	}
+	for _, line := range sections["lsblk"] {
+		disk := pairs(line)
+		if disk["TYPE"] != "disk" {
+			continue
+		}
+		size, _ := strconv.ParseUint(disk["SIZE"], 10, 64)
+		facts.Disks = append(facts.Disks, Disk{Name: disk["NAME"], Size: size, SSD: disk["ROTA"] == "0"})
+	}
+	facts.NICs = parseIPLinks(sections["link"], sections["addr"])
+	for _, line := range sections["packages"] {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			facts.Packages[fields[0]] = fields[1]
+		}
+	}
+	return facts, nil
+}
+
+//parseIPLinks reads ip -o link and ip -o addr output, leaving out the loopback interface
+func parseIPLinks(links []string, addrs []string) []NIC {
+	var nics []NIC
+	index := map[string]int{}
+	for _, line := range links {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		name := strings.SplitN(strings.TrimSuffix(fields[1], ":"), "@", 2)[0]
+		if name == "lo" {
+			continue
+		}
+		nic := NIC{Name: name, Up: strings.Contains(fields[2], ",UP") || strings.Contains(fields[2], "<UP")}
+		for i := 3; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "mtu":
+				nic.MTU, _ = strconv.Atoi(fields[i+1])
+			case "link/ether":
+				nic.MAC = fields[i+1]
+			}
+		}
+		index[name] = len(nics)
+		nics = append(nics, nic)
+	}
+	for _, line := range addrs {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		if i, ok := index[fields[1]]; ok {
+			nics[i].Addresses = append(nics[i].Addresses, fields[3])
+		}
+	}
+	return nics
+}
+
+func parseESXiFacts(sections map[string][]string) (*Facts, error) {
+	facts := &Facts{OS: OSESXi, Packages: map[string]string{}}
+	parseUname(facts, sections["uname"])
+	if facts.Kernel == "" {
+		return nil, fmt.Errorf("Unable to gather host facts: no kernel version in output")
+	}
+	facts.Release = Release{ID: "esxi", Version: facts.Kernel}
+	if lines := sections["version"]; len(lines) > 0 {
+		facts.Release.Name = strings.TrimSpace(lines[0])
+		if fields := strings.Fields(lines[0]); len(fields) >= 3 {
+			facts.Release.Version = fields[2]
+		}
+	}
+	if cpu := csvRows(sections["cpu"]); len(cpu) > 0 {
+		facts.CPUs, _ = strconv.Atoi(cpu[0]["CPUThreads"])
+	}
+	if memory := csvRows(sections["memory"]); len(memory) > 0 {
+		facts.Memory, _ = strconv.ParseUint(memory[0]["PhysicalMemory"], 10, 64)
+	}
+	for _, device := range csvRows(sections["devices"]) {
+		if device["DeviceType"] != "Direct-Access" {
+			continue
+		}
+		mb, _ := strconv.ParseUint(device["Size"], 10, 64)
+		facts.Disks = append(facts.Disks, Disk{Name: device["Device"], Size: mb << 20, SSD: device["IsSSD"] == "true"})
+	}
+	for _, nic := range csvRows(sections["nics"]) {
+		mtu, _ := strconv.Atoi(nic["MTU"])
+		facts.NICs = append(facts.NICs, NIC{Name: nic["Name"], MAC: nic["MACAddress"], MTU: mtu, Up: nic["LinkStatus"] == "Up"})
+	}
+	index := map[string]int{}
+	for _, vmknic := range csvRows(sections["vmknics"]) {
+		mtu, _ := strconv.Atoi(vmknic["MTU"])
+		index[vmknic["Name"]] = len(facts.NICs)
+		facts.NICs = append(facts.NICs, NIC{Name: vmknic["Name"], MAC: vmknic["MACAddress"], MTU: mtu, Up: vmknic["Enabled"] == "true"})
+	}
+	for _, ipv4 := range csvRows(sections["ipv4"]) {
+		i, ok := index[ipv4["Name"]]
+		if !ok || ipv4["IPv4Address"] == "" {
+			continue
+		}
+		facts.NICs[i].Addresses = append(facts.NICs[i].Addresses, ipv4["IPv4Address"]+"/"+netmaskBits(ipv4["IPv4Netmask"]))
+	}
+	for _, vib := range csvRows(sections["vibs"]) {
+		if strings.Contains(strings.ToLower(vib["Name"]), "scaleio") {
+			facts.Packages[vib["Name"]] = vib["Version"]
+		}
+	}
+	return facts, nil
+}
+
+//keyValues parses KEY<sep>value lines, trimming spaces and quotes from the values
+func keyValues(lines []string, sep string) map[string]string {
+	values := map[string]string{}
+	for _, line := range lines {
+		kv := strings.SplitN(line, sep, 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	return values
+}
+
+//pairs parses the KEY="value" pairs lsblk -P prints
+func pairs(line string) map[string]string {
+	values := map[string]string{}
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return values
+}
+
+//csvRows parses esxcli CSV output into one map per row keyed by the header
+func csvRows(lines []string) []map[string]string {
+	if len(lines) < 2 {
+		return nil
+	}
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil || len(records) < 2 {
+		return nil
+	}
+	var rows []map[string]string
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, name := range records[0] {
+			if i < len(record) && name != "" {
+				row[name] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+//netmaskBits turns a dotted netmask into a prefix length
+func netmaskBits(mask string) string {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return "32"
+	}
+	bits, _ := net.IPMask(ip).Size()
+	return strconv.Itoa(bits)
+}
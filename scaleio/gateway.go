@@ -0,0 +1,91 @@
+package scaleio
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/howels/infra-tools/ssh"
+)
+
+//GatewayPort is the HTTPS port the ScaleIO Gateway REST API listens on
+const GatewayPort = 443
+
+//GatewayClient is a minimal client for the ScaleIO Gateway REST API
+type GatewayClient struct {
+	URL      string //base URL such as https://127.0.0.1:8443
+	User     string
+	Password string
+	HTTP     *http.Client
+	token    string
+}
+
+//NewGatewayClient simple constructor, insecure skips verification of the gateway's self-signed certificate
+func NewGatewayClient(url string, user string, password string, insecure bool) *GatewayClient {
+	sshclient.RegisterLogin(user, password)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}}
+	return &GatewayClient{URL: strings.TrimSuffix(url, "/"), User: user, Password: password, HTTP: &http.Client{Transport: transport}}
+}
+
+//Client forwards a local port to the gateway over the node's SSH connection and returns a REST client for it.
+//The forward is closed when the context ends.
+func (node *GatewayNode) Client(ctx context.Context) (*GatewayClient, error) {
+	forwarder, ok := sshclient.Unwrap(node.SSH).(sshclient.Forwarder)
+	if !ok {
+		return nil, fmt.Errorf("Connection to %v cannot forward ports, unable to reach the gateway", node.Hostname)
+	}
+	forward, err := forwarder.ForwardLocal(ctx, "127.0.0.1:0", net.JoinHostPort("127.0.0.1", strconv.Itoa(GatewayPort)))
+	if err != nil {
+		return nil, err
+	}
+	return NewGatewayClient(fmt.Sprintf("https://127.0.0.1:%v", forward.Port()), "admin", node.ScaleIO.Password, true), nil
+}
+
+//Login fetches the session token used by later requests
+func (gw *GatewayClient) Login(ctx context.Context) error {
+	var token string
+	if err := gw.request(ctx, "/api/login", gw.Password, &token); err != nil {
+		return err
+	}
+	sshclient.RegisterSecret(token)
+	gw.token = token
+	return nil
+}
+
+//Get decodes the JSON response for an API path such as /api/types/System/instances, logging in first if needed
+func (gw *GatewayClient) Get(ctx context.Context, path string, result interface{}) error {
+	if gw.token == "" {
+		if err := gw.Login(ctx); err != nil {
+			return err
+		}
+	}
+	return gw.request(ctx, path, gw.token, result)
+}
+
+func (gw *GatewayClient) request(ctx context.Context, path string, secret string, result interface{}) error {
+	req, err := http.NewRequest("GET", gw.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(gw.User, secret)
+	resp, err := gw.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("Gateway request %v failed: %v", path, sshclient.Redact(err.Error()))
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Gateway request %v failed with %v: %v", path, resp.Status, sshclient.Redact(strings.TrimSpace(string(body))))
+	}
+	return json.Unmarshal(body, result)
+}
@@ -3,8 +3,6 @@ package scaleio
 import (
 	"net"
 
-	"fmt"
-
 	"github.com/howels/infra-tools/ssh"
 )
 
@@ -14,14 +12,14 @@ type GatewayNode struct {
 	ScaleIO *ScaleIO
 }
 
-//NewGatewayNode passes a new node object
-func NewGatewayNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO) *GatewayNode {
+//NewGatewayNode passes a new node object, options configure SSH auth
+func NewGatewayNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO, options ...sshclient.Option) *GatewayNode {
 
 	ip, _, err := net.ParseCIDR(ManagementCIDR)
 	if err != nil {
 		panic(err)
 	}
-	sshClient := sshclient.NewSSHClient(Username, Password, ip.String())
+	sshClient := sshclient.NewSSHClient(Username, Password, ip.String(), options...)
 	var Become string
 	if UseSudo {
 		Become = "sudo bash -c "
@@ -35,8 +33,9 @@ func NewGatewayNode(Username string, Password string, Hostname string, DataCIDR
 		Become:            Become,
 	}
 	node.Installation.InstallCommands = []string{"yum install java-1.8.0-openjdk-headless",
-		"export SIO_GW_JAVA=/usr/java/default",
-		fmt.Sprintf("export GATEWAY_ADMIN_PASSWORD=%v", ScaleIO.Password),
-		"cd /root/install && rpm -i EMC-ScaleIO-gateway-*.rpm"}
+		"cd /root/install && GATEWAY_ADMIN_PASSWORD=\"$GATEWAY_ADMIN_PASSWORD\" rpm -i EMC-ScaleIO-gateway-*.rpm"}
+	node.Installation.Packages = []string{"EMC-ScaleIO-gateway"}
+	node.Installation.Env = []string{"SIO_GW_JAVA=/usr/java/default"}
+	node.Installation.Secrets = []sshclient.Secret{{Name: "GATEWAY_ADMIN_PASSWORD", Value: ScaleIO.Password}}
 	return &GatewayNode{Node: node, ScaleIO: ScaleIO}
 }
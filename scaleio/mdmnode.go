@@ -1,8 +1,8 @@
 package scaleio
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 
 	"github.com/howels/infra-tools/ssh"
@@ -14,14 +14,14 @@ type MDMNode struct {
 	ScaleIO *ScaleIO
 }
 
-//NewMDMNode passes a new node object
-func NewMDMNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO) *MDMNode {
+//NewMDMNode passes a new node object, options configure SSH auth
+func NewMDMNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO, options ...sshclient.Option) *MDMNode {
 
 	ip, _, err := net.ParseCIDR(ManagementCIDR)
 	if err != nil {
 		panic(err)
 	}
-	sshClient := sshclient.NewSSHClient(Username, Password, ip.String())
+	sshClient := sshclient.NewSSHClient(Username, Password, ip.String(), options...)
 	var Become string
 	if UseSudo {
 		Become = "sudo bash -c "
@@ -35,16 +35,48 @@ func NewMDMNode(Username string, Password string, Hostname string, DataCIDR []st
 		Become:            Become,
 	}
 	node.Installation.InstallCommands = []string{"cd /root/install && MDM_ROLE_IS_MANAGER=1 rpm -i EMC-ScaleIO-mdm-*.rpm"}
+	node.Installation.Packages = []string{"EMC-ScaleIO-mdm"}
 	return &MDMNode{Node: node, ScaleIO: ScaleIO}
 }
 
+//scli runs scli on this MDM, every argument is quoted
+func (mdm *MDMNode) scli(ctx context.Context, args ...string) (*sshclient.CommandOutput, error) {
+	return mdm.CommandArgs(ctx, sshclient.Args("scli", args...))
+}
+
+//query runs a read-only scli command on this MDM and returns its output without echoing it
+func (mdm *MDMNode) query(ctx context.Context, args ...string) (string, error) {
+	output, err := mdm.ExecuteContext(ctx, &sshclient.Command{Command: sshclient.Args("scli", args...).String(), OnStdout: quiet})
+	if err != nil {
+		return "", err
+	}
+	return output.Stdout, nil
+}
+
+//secretFlag is an scli option whose value must stay off the command line
+type secretFlag struct {
+	flag  string
+	value string
+}
+
+//scliSecret runs scli on this MDM with the secret flags appended, their values are sent on stdin
+func (mdm *MDMNode) scliSecret(ctx context.Context, flags []secretFlag, args ...string) (*sshclient.CommandOutput, error) {
+	line := sshclient.Args("scli", args...).String()
+	var secrets []sshclient.Secret
+	for i, f := range flags {
+		name := fmt.Sprintf("SCLI_SECRET%v", i)
+		line += fmt.Sprintf(" %v \"$%v\"", f.flag, name)
+		secrets = append(secrets, sshclient.Secret{Name: name, Value: f.value})
+	}
+	return mdm.ExecuteContext(ctx, sshclient.SecretCommand(line, secrets...))
+}
+
 func (mdm *MDMNode) login() error {
-	loginCommand := fmt.Sprintf("scli --mdm_ip=%v --login --username admin --password %v", mdm.DataIPString(), mdm.ScaleIO.Password)
-	output, err := mdm.Command(loginCommand)
+	output, err := mdm.scliSecret(context.Background(), []secretFlag{{"--password", mdm.ScaleIO.Password}}, "--mdm_ip="+mdm.DataIPString(), "--login", "--username", "admin")
 	if err != nil {
 		return err
 	}
-	log.Printf("Login success: %v", output.Stdout)
+	logf("Login success: %v", output.Stdout)
 	return nil
 
 }
@@ -0,0 +1,295 @@
+package scaleio
+
+import (
+	"fmt"
+	"strings"
+)
+
+//clusterModes gives the scli --cluster_mode value of each mode and the MDM managers and tie-breakers it runs with
+var clusterModes = map[string]struct {
+	flag string
+	mdms int //the master and its slaves
+	tbs  int
+}{
+	ModeSingleNode: {"1_node", 1, 0},
+	Mode3Node:      {"3_node", 2, 1},
+	Mode5Node:      {"5_node", 3, 2},
+}
+
+//ActivateCluster switches the MDMs to the mode with Options.NumberMDM managers and Options.NumberTB tie-breakers
+func (cluster *Cluster) ActivateCluster() error {
+	if cluster.Options == nil {
+		cluster.Defaults()
+	}
+	mode, err := cluster.Options.mode()
+	if err != nil {
+		return err
+	}
+	return cluster.SwitchMode(mode)
+}
+
+//SwitchMode grows or shrinks the MDM cluster to SingleNode, 3_node or 5_node mode and checks scli reports the new mode.
+//Growing registers the MDMs and TBs it needs as standbys first, shrinking leaves the slaves and tie-breakers it
+//drops as standbys, which RemoveStandby removes.
+func (cluster *Cluster) SwitchMode(mode string) error {
+	target, ok := clusterModes[mode]
+	if !ok {
+		return fmt.Errorf("Unknown cluster mode %v, use %v, %v or %v", mode, ModeSingleNode, Mode3Node, Mode5Node)
+	}
+	if len(cluster.MDMs) < target.mdms {
+		return fmt.Errorf("Need %v MDM nodes for %v mode, found only %v", target.mdms, mode, len(cluster.MDMs))
+	}
+	if len(cluster.TBs) < target.tbs {
+		return fmt.Errorf("Need %v TB nodes for %v mode, found only %v", target.tbs, mode, len(cluster.TBs))
+	}
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	state, err := cluster.queryCluster()
+	if err != nil {
+		return err
+	}
+	if state.Mode == mode {
+		logf("Cluster is already in %v mode", mode)
+		cluster.State, cluster.IsCluster = state, state.Clustered()
+		return nil
+	}
+	current, ok := clusterModes[state.Mode]
+	if !ok {
+		return fmt.Errorf("Unable to switch cluster from unknown mode %v", state.Mode)
+	}
+	slaves, tbs := names(state.Members(RoleSlave)), names(state.Members(RoleTieBreaker))
+	args := []string{"--mdm_ip=" + cluster.mdmIP(), "--switch_cluster_mode", "--cluster_mode", target.flag}
+	if target.mdms > current.mdms {
+		var mdms, tbNodes []*Node
+		for _, mdm := range cluster.MDMs {
+			mdms = append(mdms, mdm.Node)
+		}
+		for _, tb := range cluster.TBs {
+			tbNodes = append(tbNodes, tb.Node)
+		}
+		addSlaves, err := cluster.standbys(state, mdms, "manager", target.mdms-1-len(slaves))
+		if err != nil {
+			return err
+		}
+		addTBs, err := cluster.standbys(state, tbNodes, "tb", target.tbs-len(tbs))
+		if err != nil {
+			return err
+		}
+		args = appendNames(args, "--add_slave_mdm_name", addSlaves)
+		args = appendNames(args, "--add_tb_name", addTBs)
+		if state.Mode == ModeSingleNode {
+			//a single node MDM has to be switched to cluster mode before it takes slaves and tie-breakers
+			_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--switch_to_cluster_mode")
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		args = appendNames(args, "--remove_slave_mdm_name", beyond(slaves, target.mdms-1))
+		args = appendNames(args, "--remove_tb_name", beyond(tbs, target.tbs))
+	}
+	_, err = cluster.scli(args...)
+	if err != nil {
+		return err
+	}
+	cluster.IsCluster = mode != ModeSingleNode
+	if !cluster.IsCluster {
+		//a single MDM is reached on its own IPs, which must be the master's
+		cluster.masterFirst(state)
+	}
+	state, err = cluster.queryCluster()
+	if err != nil {
+		return err
+	}
+	cluster.State, cluster.IsCluster = state, state.Clustered()
+	slaveCount, tbCount := len(state.Members(RoleSlave)), len(state.Members(RoleTieBreaker))
+	if state.Mode != mode || slaveCount != target.mdms-1 || tbCount != target.tbs {
+		return fmt.Errorf("Cluster reports %v mode with %v slave MDMs and %v tie-breakers after switching to %v", state.Mode, slaveCount, tbCount, mode)
+	}
+	logf("Switched cluster from %v to %v mode", current.flag, target.flag)
+	return nil
+}
+
+//AddMDMStandby adds the other MDM node as a standby manager
+func (cluster *Cluster) AddMDMStandby(mdm MDMNode) error {
+	return cluster.addStandby(mdm.Node, "manager")
+}
+
+//AddMDM registers the MDM node as a standby manager, ready to become a slave, and adds it to cluster.MDMs
+func (cluster *Cluster) AddMDM(mdm *MDMNode) error {
+	err := cluster.addStandby(mdm.Node, "manager")
+	if err != nil {
+		return err
+	}
+	for _, known := range cluster.MDMs {
+		if known == mdm {
+			return nil
+		}
+	}
+	cluster.MDMs = append(cluster.MDMs, mdm)
+	return nil
+}
+
+//AddTB registers the TB node as a standby tie-breaker and adds it to cluster.TBs
+func (cluster *Cluster) AddTB(tb *TBNode) error {
+	err := cluster.addStandby(tb.Node, "tb")
+	if err != nil {
+		return err
+	}
+	for _, known := range cluster.TBs {
+		if known == tb {
+			return nil
+		}
+	}
+	cluster.TBs = append(cluster.TBs, tb)
+	return nil
+}
+
+//RemoveStandby unregisters a standby MDM or tie-breaker by name, scli refuses for active members
+func (cluster *Cluster) RemoveStandby(name string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--remove_standby_mdm", "--remove_mdm_name", name)
+	if err != nil {
+		return err
+	}
+	logf("Removed standby %v", name)
+	return nil
+}
+
+//addStandby registers the node as a standby with the role, manager or tb, unless the cluster already has it
+func (cluster *Cluster) addStandby(node *Node, role string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	state, err := cluster.queryCluster()
+	if err != nil {
+		return err
+	}
+	if info := state.member(node); info != nil {
+		logf("%v is already in the cluster as %v", node.Hostname, info.Role)
+		return nil
+	}
+	return cluster.registerStandby(node, role)
+}
+
+func (cluster *Cluster) registerStandby(node *Node, role string) error {
+	args := []string{"--mdm_ip=" + cluster.mdmIP(), "--add_standby_mdm", "--new_mdm_ip", node.DataIPString(), "--mdm_role", role, "--new_mdm_name", node.Hostname}
+	if role == "manager" {
+		args = append(args, "--new_mdm_management_ip", node.MgmtIPString())
+	}
+	_, err := cluster.scli(args...)
+	if err != nil {
+		return err
+	}
+	logf("Added %v as standby %v", node.Hostname, role)
+	return nil
+}
+
+//standbys picks n of the nodes that are not active members, registering those the cluster does not know yet
+//as standbys with the role, and returns their names for scli. Standbys registered with the other role are passed over.
+func (cluster *Cluster) standbys(state *ClusterState, nodes []*Node, role string, n int) ([]string, error) {
+	var picked []string
+	for _, node := range nodes {
+		if len(picked) == n {
+			break
+		}
+		info := state.member(node)
+		if info == nil {
+			err := cluster.registerStandby(node, role)
+			if err != nil {
+				return nil, err
+			}
+			picked = append(picked, node.Hostname)
+		} else if info.Role == RoleStandby && standbyRole(info.StandbyRole) == role {
+			picked = append(picked, info.Name)
+		}
+	}
+	if len(picked) < n {
+		return nil, fmt.Errorf("Need %v more %v nodes outside the cluster, found only %v", n, role, len(picked))
+	}
+	return picked, nil
+}
+
+//standbyRole turns the role scli shows for a standby, Manager or Tie Breaker, into the --mdm_role value
+func standbyRole(shown string) string {
+	switch strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(shown)) {
+	case "manager":
+		return "manager"
+	case "tiebreaker", "tb":
+		return "tb"
+	}
+	return ""
+}
+
+//masterFirst moves the master MDM to the front of cluster.MDMs
+func (cluster *Cluster) masterFirst(state *ClusterState) {
+	master := state.Master()
+	if master == nil {
+		return
+	}
+	for i, mdm := range cluster.MDMs {
+		if state.member(mdm.Node) == master {
+			cluster.MDMs = rotate(cluster.MDMs, i)
+			return
+		}
+	}
+}
+
+//member finds the node among the MDMs by name or data IP, nil if the cluster does not have it
+func (state *ClusterState) member(node *Node) *MDMInfo {
+	ips := strings.Split(node.DataIPString(), ",")
+	for i := range state.MDMs {
+		mdm := &state.MDMs[i]
+		if mdm.Name == node.Hostname {
+			return mdm
+		}
+		for _, ip := range mdm.IPs {
+			for _, own := range ips {
+				if ip == own {
+					return mdm
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//mode is the cluster mode with NumberMDM managers and NumberTB tie-breakers
+func (options *clusterOptions) mode() (string, error) {
+	for mode, size := range clusterModes {
+		if size.mdms == options.NumberMDM && size.tbs == options.NumberTB {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("No cluster mode has %v MDMs and %v TBs, use 1 and 0, 2 and 1 or 3 and 2", options.NumberMDM, options.NumberTB)
+}
+
+func names(mdms []MDMInfo) []string {
+	var names []string
+	for _, mdm := range mdms {
+		names = append(names, mdm.Name)
+	}
+	return names
+}
+
+//beyond returns the names after the first n
+func beyond(names []string, n int) []string {
+	if len(names) <= n {
+		return nil
+	}
+	return names[n:]
+}
+
+//appendNames adds the flag with the names as its comma separated value, nothing if there are none
+func appendNames(args []string, flag string, names []string) []string {
+	if len(names) == 0 {
+		return args
+	}
+	return append(args, flag, strings.Join(names, ","))
+}
@@ -1,9 +1,13 @@
 package scaleio
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/howels/infra-tools/ssh"
 )
@@ -22,12 +26,24 @@ type SecureShellClient struct {
 // 	managementIP IPNet
 // }
 
+//printStdout echoes remote stdout line by line as commands run
+var printStdout = sshclient.PrintLines(os.Stdout)
+
+//RemoteInstallDir is where the install commands expect the ScaleIO packages
+const RemoteInstallDir = "/root/install"
+
 //Installation describes commands for install
 type Installation struct {
 	PrereqCommands  []string
 	InstallCommands []string
 	EraseCommands   []string
 	SioPackageURL   string
+	PackageDir      string             //local directory pushed to RemoteInstallDir before the prereqs run, instead of each node fetching SioPackageURL
+	Secrets         []sshclient.Secret //sent on stdin to the commands that refer to them as "$NAME", never on the command line
+	Files           []sshclient.File   //config files written with the node's privileges after the erase commands
+	Env             []string           //NAME=value pairs set for every installation command
+	Packages        []string           //packages the install commands provide, the erase and install commands are skipped when all are already installed
+	Reinstall       bool               //run the erase and install commands even when Packages are already installed
 }
 
 //InstallationManager is intended to be an opportunity for DI of installation methods
@@ -35,6 +51,13 @@ type InstallationManager interface {
 	Install() error
 }
 
+//NodeInstaller is implemented by every node type so mixed sets of nodes can be installed together
+type NodeInstaller interface {
+	InstallationManager
+	InstallContext(ctx context.Context) error
+	Name() string
+}
+
 //Node describes the properties of the VM to be built
 type Node struct {
 	SSH               sshclient.ShellConnection
@@ -42,17 +65,21 @@ type Node struct {
 	DataNetworks      []string
 	ManagementNetwork string
 	Hostname          string
-	Become            string
+	Become            string            //shell prefix commands are wrapped in when Escalation is nil
+	Escalation        *sshclient.Become //opt-in sudo or su settings that answer password prompts, replaces Become when set
+
+	factsMu sync.Mutex
+	facts   *Facts
 }
 
-//NewNode passes a new node object
-func NewNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool) *Node {
+//NewNode passes a new node object, options configure SSH auth
+func NewNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, options ...sshclient.Option) *Node {
 
 	ip, _, err := net.ParseCIDR(ManagementCIDR)
 	if err != nil {
 		panic(err)
 	}
-	sshClient := sshclient.NewSSHClient(Username, Password, ip.String())
+	sshClient := sshclient.NewSSHClient(Username, Password, ip.String(), options...)
 	var Become string
 	if UseSudo {
 		Become = "sudo bash -c "
@@ -67,22 +94,67 @@ func NewNode(Username string, Password string, Hostname string, DataCIDR []strin
 	}
 }
 
-//Command executes an SSH command
+//EscalateWithSudo makes the node answer sudo password prompts with the password, for hosts without NOPASSWD sudoers.
+//Nodes use their Become prefix until this or Escalation is set.
+func (node *Node) EscalateWithSudo(password string) {
+	node.Escalation = &sshclient.Become{Method: sshclient.BecomeSudo, Password: password}
+}
+
+//Command executes an SSH command, a non-zero exit is returned as an *sshclient.ExitError
 func (node *Node) Command(cmd string) (*sshclient.CommandOutput, error) {
+	return node.CommandContext(context.Background(), cmd)
+}
+
+//CommandContext executes an SSH command that is killed if the context ends first
+func (node *Node) CommandContext(ctx context.Context, cmd string) (*sshclient.CommandOutput, error) {
 	// s := sshclient.NewSSHClient("sshtest", "sshtest", "localhost")
-	out, err := node.SSH.Command(node.Become + "\"" + cmd + "\"")
-	if err != nil {
-		return out, err
+	return node.ExecuteContext(ctx, &sshclient.Command{Command: cmd})
+}
+
+//Execute runs the command with the node's privileges, so a Node can be used as a ShellConnection
+func (node *Node) Execute(cmd *sshclient.Command) (*sshclient.CommandOutput, error) {
+	return node.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs the command with the node's Escalation or through its Become prefix,
+//remote stdout is echoed unless OnStdout is set
+func (node *Node) ExecuteContext(ctx context.Context, cmd *sshclient.Command) (*sshclient.CommandOutput, error) {
+	wrapped := *cmd
+	if node.Escalation != nil {
+		wrapped.Become = node.Escalation
+	} else {
+		//sudo drops the session env, so it is exported inside the wrapped command instead
+		prefix, err := sshclient.ExportPrefix(cmd.Env)
+		if err != nil {
+			return nil, err
+		}
+		wrapped.Command = node.Become + sshclient.Quote(prefix+cmd.Command)
+		wrapped.Env = nil
 	}
-	fmt.Println(string(out.Stdout))
-	return out, nil
+	if wrapped.OnStdout == nil {
+		wrapped.OnStdout = printStdout
+	}
+	return node.SSH.ExecuteContext(ctx, &wrapped)
+}
+
+//CommandArgs executes a program with its arguments quoted, so they are passed through bash -c and sudo unchanged
+func (node *Node) CommandArgs(ctx context.Context, argv sshclient.Argv) (*sshclient.CommandOutput, error) {
+	return node.CommandContext(ctx, argv.String())
 }
 
-//Commands executes a list of commands
+//Commands executes a list of commands, stopping at the first failure
 func (node *Node) Commands(cmds []string) ([]*sshclient.CommandOutput, error) {
+	return node.CommandsContext(context.Background(), cmds)
+}
+
+//CommandsContext executes a list of commands with the node's privileges, stopping at the first failure or when the context ends.
+//Installation secrets referred to by a command are passed to it on stdin and Installation.Env is set for each.
+func (node *Node) CommandsContext(ctx context.Context, cmds []string) ([]*sshclient.CommandOutput, error) {
 	var output []*sshclient.CommandOutput
 	for _, cmd := range cmds {
-		out, err := node.SSH.Command(cmd)
+		command := sshclient.SecretCommand(cmd, node.Installation.Secrets...)
+		command.Env = node.Installation.Env
+		out, err := node.ExecuteContext(ctx, command)
 		output = append(output, out)
 		if err != nil {
 			return output, err
@@ -93,21 +165,167 @@ func (node *Node) Commands(cmds []string) ([]*sshclient.CommandOutput, error) {
 
 //Install sets up the VM
 func (node *Node) Install() error {
-	_, err := node.Commands(node.Installation.PrereqCommands)
+	return node.InstallContext(context.Background())
+}
+
+//InstallContext sets up the VM, abandoning the remaining commands if the context ends.
+//Packages that are already installed skip the erase and install commands unless Reinstall is set.
+func (node *Node) InstallContext(ctx context.Context) error {
+	installed, err := node.installed(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = node.Commands(node.Installation.EraseCommands)
+	if installed {
+		logf("%v already installed on %v, skipping install commands", strings.Join(node.Installation.Packages, ", "), node.Hostname)
+	} else {
+		err = node.pushPackages(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = node.CommandsContext(ctx, node.Installation.PrereqCommands)
 	if err != nil {
 		return err
 	}
-	_, err = node.Commands(node.Installation.InstallCommands)
+	if !installed {
+		_, err = node.CommandsContext(ctx, node.Installation.EraseCommands)
+		if err != nil {
+			return err
+		}
+	}
+	err = node.applyFiles(ctx)
+	if err != nil {
+		return err
+	}
+	if installed {
+		return nil
+	}
+	_, err = node.CommandsContext(ctx, node.Installation.InstallCommands)
+	node.forgetFacts()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+//installed reports whether all of Installation.Packages are installed already, gathering facts only when packages
+//are listed. Hosts whose facts cannot be gathered get the full install as before.
+func (node *Node) installed(ctx context.Context) (bool, error) {
+	if len(node.Installation.Packages) == 0 || node.Installation.Reinstall {
+		return false, nil
+	}
+	facts, err := node.Facts(ctx)
+	if err != nil {
+		logf("%v, running the install commands", err)
+		return false, nil
+	}
+	if facts.OS != OSLinux {
+		return false, fmt.Errorf("Unable to install on %v: ScaleIO node packages need Linux, found %v", node.Hostname, facts.Release.Name)
+	}
+	return facts.Installed(node.Installation.Packages...), nil
+}
+
+//Facts returns the node's OS, hardware, network and package facts, gathered over SSH on first use and cached
+func (node *Node) Facts(ctx context.Context) (*Facts, error) {
+	node.factsMu.Lock()
+	defer node.factsMu.Unlock()
+	if node.facts != nil {
+		return node.facts, nil
+	}
+	facts, err := GatherFacts(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to gather facts for %v: %v", node.Hostname, err)
+	}
+	logf("Facts for %v: %v", node.Hostname, facts)
+	node.facts = facts
+	return facts, nil
+}
+
+//RefreshFacts discards the cached facts and gathers them again
+func (node *Node) RefreshFacts(ctx context.Context) (*Facts, error) {
+	node.forgetFacts()
+	return node.Facts(ctx)
+}
+
+//forgetFacts drops the cache after commands that change what is installed
+func (node *Node) forgetFacts() {
+	node.factsMu.Lock()
+	defer node.factsMu.Unlock()
+	node.facts = nil
+}
+
+//InstallNodes runs the installations in parallel under the fan-out policy, hostnames must be unique as they key the report
+func InstallNodes(ctx context.Context, fan sshclient.FanOut, nodes ...NodeInstaller) *sshclient.Report {
+	var hosts []string
+	byHost := map[string]NodeInstaller{}
+	for _, node := range nodes {
+		hosts = append(hosts, node.Name())
+		byHost[node.Name()] = node
+	}
+	return fan.Run(ctx, hosts, func(ctx context.Context, host string) (*sshclient.CommandOutput, error) {
+		return nil, byHost[host].InstallContext(ctx)
+	})
+}
+
+//Record logs every command sent to the node to w as JSONL, labelled with the node's hostname
+func (node *Node) Record(w io.Writer) {
+	node.SSH = sshclient.NewRecorder(node.SSH, node.Hostname, w)
+}
+
+//Replay answers the node's commands from a recording instead of a live connection
+func (node *Node) Replay(records []*sshclient.Record) *sshclient.Replayer {
+	replayer := sshclient.NewReplayer(records, node.Hostname)
+	node.SSH = replayer
+	return replayer
+}
+
+//Name is the node's hostname
+func (node *Node) Name() string {
+	return node.Hostname
+}
+
+//applyFiles writes the installation's config files, logging the ones that changed
+func (node *Node) applyFiles(ctx context.Context) error {
+	for i := range node.Installation.Files {
+		result, err := node.Installation.Files[i].Apply(ctx, node)
+		if err != nil {
+			return err
+		}
+		if result.Changed {
+			logf("Updated %v on %v", result.Path, node.Hostname)
+		}
+	}
+	return nil
+}
+
+//pushPackages uploads the local package directory, if one is set, to a staging directory the login user owns and
+//moves it into RemoteInstallDir with the node's privileges, as a sudo user cannot write under /root over SFTP
+func (node *Node) pushPackages(ctx context.Context) error {
+	if node.Installation.PackageDir == "" {
+		return nil
+	}
+	transfer, ok := sshclient.Unwrap(node.SSH).(sshclient.FileTransfer)
+	if !ok {
+		return fmt.Errorf("Connection to %v cannot transfer files, unable to push %v", node.Hostname, node.Installation.PackageDir)
+	}
+	out, err := node.SSH.ExecuteContext(ctx, &sshclient.Command{Command: "mktemp -d /tmp/scaleio-install.XXXXXX", OnStdout: quiet})
+	if err != nil {
+		return fmt.Errorf("Unable to create a staging directory on %v: %v", node.Hostname, err)
+	}
+	staging := strings.TrimSpace(out.Stdout)
+	err = transfer.UploadDir(ctx, node.Installation.PackageDir, staging, &sshclient.TransferOptions{Verify: true, Progress: sshclient.LogProgress()})
+	if err != nil {
+		node.SSH.ExecuteContext(ctx, &sshclient.Command{Command: "rm -rf " + sshclient.Quote(staging), OnStdout: quiet})
+		return err
+	}
+	dir := sshclient.Quote(RemoteInstallDir)
+	_, err = node.ExecuteContext(ctx, &sshclient.Command{
+		Command:  fmt.Sprintf("rm -rf %v && mv %v %v && chown -R root:root %v", dir, sshclient.Quote(staging), dir, dir),
+		OnStdout: quiet,
+	})
+	return err
+}
+
 //MgmtIP produces the IP needed to connect.
 func (node *Node) MgmtIP() net.IP {
 	ip, _, err := net.ParseCIDR(node.ManagementNetwork)
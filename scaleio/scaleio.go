@@ -1,28 +1,42 @@
 package scaleio
 
 import (
+	"context"
 	"fmt"
+	"log"
+
+	"github.com/howels/infra-tools/ssh"
 )
 
 //ScaleIO describes the properties of the overall ScaleIO environment
 type ScaleIO struct {
-	Password   string //defaults to 'admin' on initial install
-	MaxRetries int
+	Password   string                //defaults to 'admin' on initial install
+	MaxRetries int                   //login attempts when Retry.Attempts is not set
+	Retry      sshclient.RetryPolicy //retries scli logins, rejections are retried as well as transport errors by default
 }
 
 //NewCluster passes back the new struct and adds the first MDM
 func (sio *ScaleIO) NewCluster(mdm *MDMNode) (*Cluster, error) {
-	err := sio.createClusterCommand(mdm)
+	return sio.NewClusterContext(context.Background(), mdm)
+}
+
+//NewClusterContext creates the cluster and keeps the context for all later cluster operations
+func (sio *ScaleIO) NewClusterContext(ctx context.Context, mdm *MDMNode) (*Cluster, error) {
+	err := sio.createClusterCommand(ctx, mdm)
 	if err != nil {
 		return nil, err
 	}
-	cluster := &Cluster{MDMs: []*MDMNode{mdm}, TBs: []*TBNode{}, SDSs: []*SDSNode{}, ScaleIO: sio, IsCluster: false}
+	cluster := &Cluster{MDMs: []*MDMNode{mdm}, TBs: []*TBNode{}, SDSs: []*SDSNode{}, ScaleIO: sio, IsCluster: false, Context: ctx}
 	cluster.Defaults()
 	return cluster, nil
 }
 
-func (sio *ScaleIO) createClusterCommand(mdm *MDMNode) error {
-	createClusterCommand := fmt.Sprintf("scli --mdm_ip=%v --create_mdm_cluster --master_mdm_ip %v --master_mdm_management_ip %v --master_mdm_name %v --accept_license --approve_certificate", mdm.DataIPString(), mdm.DataIPString(), mdm.MgmtIPString(), mdm.Hostname)
-	_, err := mdm.Command(createClusterCommand)
+func (sio *ScaleIO) createClusterCommand(ctx context.Context, mdm *MDMNode) error {
+	_, err := mdm.scli(ctx, "--mdm_ip="+mdm.DataIPString(), "--create_mdm_cluster", "--master_mdm_ip", mdm.DataIPString(), "--master_mdm_management_ip", mdm.MgmtIPString(), "--master_mdm_name", mdm.Hostname, "--accept_license", "--approve_certificate")
 	return err
 }
+
+//logf logs a message with the registered secrets masked
+func logf(format string, args ...interface{}) {
+	log.Print(sshclient.Redact(fmt.Sprintf(format, args...)))
+}
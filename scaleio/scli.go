@@ -0,0 +1,570 @@
+package scaleio
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Cluster modes reported by scli --query_cluster
+const (
+	ModeSingleNode = "SingleNode"
+	Mode3Node      = "3_node"
+	Mode5Node      = "5_node"
+)
+
+//MDM roles in a ClusterState
+const (
+	RoleMaster     = "Master"
+	RoleSlave      = "Slave"
+	RoleTieBreaker = "TieBreaker"
+	RoleStandby    = "Standby"
+)
+
+//ClusterState is the MDM cluster as reported by scli --query_cluster
+type ClusterState struct {
+	Name     string
+	ID       string
+	Mode     string //SingleNode, 3_node or 5_node
+	State    string //Normal, Degraded or Not clustered
+	Active   string //active members out of all members, such as 3/3
+	Replicas string
+	MDMs     []MDMInfo
+}
+
+//MDMInfo is one member of the MDM cluster
+type MDMInfo struct {
+	Name          string
+	ID            string
+	Role          string //Master, Slave, TieBreaker or Standby
+	StandbyRole   string //Manager or TieBreaker for standby MDMs
+	IPs           []string
+	ManagementIPs []string
+	Port          int
+	Status        string
+	Version       string
+}
+
+//SDSInfo is one SDS as reported by scli --query_all_sds, or by scli --query_sds with its fault set and devices
+type SDSInfo struct {
+	ID                 string
+	Name               string
+	ProtectionDomainID string
+	ProtectionDomain   string
+	FaultSetID         string
+	FaultSet           string
+	State              string //Connected or Disconnected
+	Membership         string //Joined, Decoupled or Removed
+	IPs                []string
+	Port               int
+	Version            string
+	Devices            []DeviceInfo
+}
+
+//DeviceInfo is a storage device of an SDS
+type DeviceInfo struct {
+	ID          string
+	Name        string
+	Path        string
+	StoragePool string
+	Capacity    uint64 //bytes
+	State       string
+}
+
+//VolumeInfo is one volume as reported by scli --query_all_volumes
+type VolumeInfo struct {
+	ID                 string
+	Name               string
+	ProtectionDomainID string
+	ProtectionDomain   string
+	StoragePoolID      string
+	StoragePool        string
+	Size               uint64 //bytes
+	MappedSDCs         int    //-1 when mapped to all SDCs
+	Provisioning       string //Thin or Thick
+	Mappings           []VolumeMapping
+}
+
+//VolumeMapping is an SDC a volume is mapped to, as reported by scli --query_volume
+type VolumeMapping struct {
+	SDCID          string
+	IP             string
+	Name           string
+	IOPSLimit      int //0 when unlimited
+	BandwidthLimit int //KB per second, 0 when unlimited
+}
+
+//ProtectionDomainInfo is one protection domain as reported by scli --query_all
+type ProtectionDomainInfo struct {
+	ID           string
+	Name         string
+	StoragePools int
+	FaultSets    int
+	SDSs         int
+	Volumes      int
+	Available    uint64 //bytes available for volume allocation
+}
+
+//PoolInfo is a storage pool from scli --query_all, with capacity from scli --query_storage_pool
+type PoolInfo struct {
+	ID                 string
+	Name               string
+	ProtectionDomainID string
+	ProtectionDomain   string
+	Volumes            int
+	Available          uint64 //bytes available for volume allocation
+	Total              uint64 //bytes, 0 until the pool itself is queried
+	Unused             uint64
+	InUse              uint64
+	SparePercent       int
+	ZeroPadding        bool
+	RMCache            bool //uses RAM read cache
+	Checksum           bool
+}
+
+//FaultSetInfo is one fault set as reported by scli --query_all_fault_sets
+type FaultSetInfo struct {
+	ID               string
+	Name             string
+	ProtectionDomain string
+	SDSs             []string //names of the SDS in the fault set
+}
+
+var (
+	sdsCountLine    = regexp.MustCompile(`^Query-all-SDS returned (\d+) SDS`)
+	volumeCountLine = regexp.MustCompile(`^Query-all-volumes returned (\d+) volume`)
+	domainIDLine    = regexp.MustCompile(`^Protection Domain (\S+) Name: (.*)$`)
+	poolIDLine      = regexp.MustCompile(`^Storage Pool (\S+) Name: (.*)$`)
+	sdsLine         = regexp.MustCompile(`^SDS ID: (\S+) Name: (.*?) State: ([^,]+), (\S+) IPs?: (\S+) Port: (\d+)(?: Version: (\S+))?`)
+	volumeLine      = regexp.MustCompile(`^Volume ID: (\S+) Name: (.*?) Size: .*?\((\d+) (Bytes|KB|MB|GB|TB)\) (Unmapped|Mapped to all SDCs|Mapped to (\d+) SDCs?)(?: (\w+)-provisioned)?`)
+	domainLine      = regexp.MustCompile(`^Protection Domain (.+) \(Id: (\S+)\) has (\d+) storage pools?, (\d+) Fault Sets?, (\d+) SDS nodes?, (\d+) volumes? and .*?\((\d+) (Bytes|KB|MB|GB|TB)\) available`)
+	poolLine        = regexp.MustCompile(`^Storage Pool (.+) \(Id: (\S+)\) has (\d+) volumes? and .*?\((\d+) (Bytes|KB|MB|GB|TB)\) available`)
+	poolDomainLine  = regexp.MustCompile(`^Protection Domain: (\S+) \(Name: (.*)\)$`)
+	spareLine       = regexp.MustCompile(`^Spare policy: (\d+)%`)
+	capacityLine    = regexp.MustCompile(`\((\d+) (Bytes|KB|MB|GB|TB)\) (total|unused|in-use) capacity$`)
+	sdsHeaderLine   = regexp.MustCompile(`^SDS (\S+) Name: (.*?)(?: Version: (\S+))?$`)
+	sdsDomainLine   = regexp.MustCompile(`^Protection Domain: (\S+), Name: (.*)$`)
+	sdsFaultSetLine = regexp.MustCompile(`^Fault Set: (\S+), Name: (.*)$`)
+	sdsStateLine    = regexp.MustCompile(`^(Connection|Membership) State: (\S+)`)
+	sdsIPLine       = regexp.MustCompile(`^\d+: (\S+)\s+Role:`)
+	sdsPortLine     = regexp.MustCompile(`^Port: (\d+)`)
+	deviceLine      = regexp.MustCompile(`^\d+: Name: (.*?)\s+Path: (\S+)\s+Original-path: \S+\s+ID: (\S+)`)
+	devicePoolLine  = regexp.MustCompile(`^Storage Pool: (.*?), Capacity: (\d+) (Bytes|KB|MB|GB|TB), State: (.+)$`)
+	objectIDLine    = regexp.MustCompile(`Object ID (\S+)`)
+	checksumLine    = regexp.MustCompile(`^Checksum mode: (\w+)`)
+	faultSetCount   = regexp.MustCompile(`^Protection Domain (.+) has (\d+) Fault Sets?`)
+	faultSetLine    = regexp.MustCompile(`^Fault Set ID: (\S+) Name: (.*)$`)
+	faultSetSDSLine = regexp.MustCompile(`^SDS ID: \S+ Name: (.*)$`)
+	volumeHeadLine  = regexp.MustCompile(`^>> Volume ID: (\S+) Name: (.*)$`)
+	provisionLine   = regexp.MustCompile(`^Provisioning: (\w+)`)
+	volumeSizeLine  = regexp.MustCompile(`^Size: .*?\((\d+) (Bytes|KB|MB|GB|TB)\)`)
+	mappingLine     = regexp.MustCompile(`^SDC ID: (\S+) IP: (\S+) Name: (.*?)(?:\s+Limit IOPS: (\S+) Bandwidth: (\S+).*)?$`)
+	snapshotLine    = regexp.MustCompile(`=> (\S+)`)
+)
+
+//ParseClusterState parses the output of scli --query_cluster
+func ParseClusterState(output string) (*ClusterState, error) {
+	state := &ClusterState{}
+	var section string
+	var mdm *MDMInfo
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r ")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if line == trimmed {
+			//unindented lines head the sections
+			section = strings.TrimSuffix(trimmed, ":")
+			mdm = nil
+			continue
+		}
+		fields := scliFields(trimmed)
+		if section == "Cluster" {
+			if id, ok := fields["ID"]; ok {
+				found = true
+				state.Name, state.ID, state.Mode = notAvailable(fields["Name"]), id, fields["Mode"]
+				state.State, state.Active, state.Replicas = fields["State"], fields["Active"], fields["Replicas"]
+			}
+			continue
+		}
+		role := mdmRole(section)
+		if role == "" {
+			continue
+		}
+		if indent(line) <= 4 {
+			state.MDMs = append(state.MDMs, MDMInfo{Role: role})
+			mdm = &state.MDMs[len(state.MDMs)-1]
+		}
+		if mdm == nil {
+			continue
+		}
+		for key, value := range fields {
+			switch key {
+			case "Name":
+				mdm.Name = value
+			case "ID":
+				id := strings.SplitN(value, ", ", 2)
+				mdm.ID = id[0]
+				if len(id) == 2 {
+					mdm.StandbyRole = id[1]
+				}
+			case "IPs":
+				mdm.IPs = splitList(value)
+			case "Management IPs":
+				mdm.ManagementIPs = splitList(value)
+			case "Port":
+				mdm.Port, _ = strconv.Atoi(value)
+			case "Status":
+				mdm.Status = value
+			case "Version":
+				mdm.Version = value
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Unable to parse scli --query_cluster output: no cluster ID found")
+	}
+	return state, scanner.Err()
+}
+
+//Master returns the master MDM, nil if there is none
+func (state *ClusterState) Master() *MDMInfo {
+	for i := range state.MDMs {
+		if state.MDMs[i].Role == RoleMaster {
+			return &state.MDMs[i]
+		}
+	}
+	return nil
+}
+
+//Members returns the MDMs with the role
+func (state *ClusterState) Members(role string) []MDMInfo {
+	var members []MDMInfo
+	for _, mdm := range state.MDMs {
+		if mdm.Role == role {
+			members = append(members, mdm)
+		}
+	}
+	return members
+}
+
+//Clustered reports whether the MDMs run as a 3 or 5 node cluster
+func (state *ClusterState) Clustered() bool {
+	return state.Mode == Mode3Node || state.Mode == Mode5Node
+}
+
+//ParseSDSList parses the output of scli --query_all_sds
+func ParseSDSList(output string) ([]SDSInfo, error) {
+	var sdss []SDSInfo
+	var domainID, domain string
+	expected := -1
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := sdsCountLine.FindStringSubmatch(line); m != nil {
+			expected, _ = strconv.Atoi(m[1])
+		} else if m := domainIDLine.FindStringSubmatch(line); m != nil {
+			domainID, domain = m[1], m[2]
+		} else if m := sdsLine.FindStringSubmatch(line); m != nil {
+			port, _ := strconv.Atoi(m[6])
+			sdss = append(sdss, SDSInfo{ID: m[1], Name: notAvailable(m[2]), ProtectionDomainID: domainID, ProtectionDomain: domain,
+				State: m[3], Membership: m[4], IPs: strings.Split(m[5], ","), Port: port, Version: m[7]})
+		}
+	}
+	if expected < 0 {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_sds output: no SDS count found")
+	}
+	if expected != len(sdss) {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_sds output: expected %v SDS, parsed %v", expected, len(sdss))
+	}
+	return sdss, nil
+}
+
+//ParseSDS parses the output of scli --query_sds, including the SDS's IPs and devices
+func ParseSDS(output string) (*SDSInfo, error) {
+	var sds *SDSInfo
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := sdsHeaderLine.FindStringSubmatch(line); m != nil {
+			sds = &SDSInfo{ID: m[1], Name: notAvailable(m[2]), Version: m[3]}
+			continue
+		}
+		if sds == nil {
+			continue
+		}
+		if m := sdsDomainLine.FindStringSubmatch(line); m != nil {
+			sds.ProtectionDomainID, sds.ProtectionDomain = m[1], m[2]
+		} else if m := sdsFaultSetLine.FindStringSubmatch(line); m != nil {
+			sds.FaultSetID, sds.FaultSet = m[1], m[2]
+		} else if m := sdsStateLine.FindStringSubmatch(line); m != nil {
+			if m[1] == "Connection" {
+				sds.State = m[2]
+			} else {
+				sds.Membership = m[2]
+			}
+		} else if m := sdsIPLine.FindStringSubmatch(line); m != nil {
+			sds.IPs = append(sds.IPs, m[1])
+		} else if m := sdsPortLine.FindStringSubmatch(line); m != nil {
+			sds.Port, _ = strconv.Atoi(m[1])
+		} else if m := deviceLine.FindStringSubmatch(line); m != nil {
+			sds.Devices = append(sds.Devices, DeviceInfo{Name: notAvailable(m[1]), Path: m[2], ID: m[3]})
+		} else if m := devicePoolLine.FindStringSubmatch(line); m != nil && len(sds.Devices) > 0 {
+			device := &sds.Devices[len(sds.Devices)-1]
+			device.StoragePool, device.Capacity, device.State = m[1], sizeBytes(m[2], m[3]), m[4]
+		}
+	}
+	if sds == nil {
+		return nil, fmt.Errorf("Unable to parse scli --query_sds output: no SDS found")
+	}
+	return sds, nil
+}
+
+//Device returns the SDS device with the path, nil if it has none
+func (sds *SDSInfo) Device(path string) *DeviceInfo {
+	for i := range sds.Devices {
+		if sds.Devices[i].Path == path {
+			return &sds.Devices[i]
+		}
+	}
+	return nil
+}
+
+//ParseVolumes parses the output of scli --query_all_volumes
+func ParseVolumes(output string) ([]VolumeInfo, error) {
+	var volumes []VolumeInfo
+	var domainID, domain, poolID, pool string
+	expected := -1
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := volumeCountLine.FindStringSubmatch(line); m != nil {
+			expected, _ = strconv.Atoi(m[1])
+		} else if m := domainIDLine.FindStringSubmatch(line); m != nil {
+			domainID, domain = m[1], m[2]
+		} else if m := poolIDLine.FindStringSubmatch(line); m != nil {
+			poolID, pool = m[1], m[2]
+		} else if m := volumeLine.FindStringSubmatch(line); m != nil {
+			volume := VolumeInfo{ID: m[1], Name: notAvailable(m[2]), ProtectionDomainID: domainID, ProtectionDomain: domain,
+				StoragePoolID: poolID, StoragePool: pool, Size: sizeBytes(m[3], m[4]), Provisioning: m[7]}
+			switch {
+			case m[5] == "Mapped to all SDCs":
+				volume.MappedSDCs = -1
+			case m[6] != "":
+				volume.MappedSDCs, _ = strconv.Atoi(m[6])
+			}
+			volumes = append(volumes, volume)
+		}
+	}
+	if expected < 0 {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_volumes output: no volume count found")
+	}
+	if expected != len(volumes) {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_volumes output: expected %v volumes, parsed %v", expected, len(volumes))
+	}
+	return volumes, nil
+}
+
+//ParseVolume parses the output of scli --query_volume, including the SDCs the volume is mapped to
+func ParseVolume(output string) (*VolumeInfo, error) {
+	var volume *VolumeInfo
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := volumeHeadLine.FindStringSubmatch(line); m != nil {
+			volume = &VolumeInfo{ID: m[1], Name: notAvailable(m[2])}
+			continue
+		}
+		if volume == nil {
+			continue
+		}
+		if m := provisionLine.FindStringSubmatch(line); m != nil {
+			volume.Provisioning = m[1]
+		} else if m := volumeSizeLine.FindStringSubmatch(line); m != nil {
+			volume.Size = sizeBytes(m[1], m[2])
+		} else if m := poolIDLine.FindStringSubmatch(line); m != nil {
+			volume.StoragePoolID, volume.StoragePool = m[1], m[2]
+		} else if m := domainIDLine.FindStringSubmatch(line); m != nil {
+			volume.ProtectionDomainID, volume.ProtectionDomain = m[1], m[2]
+		} else if m := mappingLine.FindStringSubmatch(line); m != nil {
+			mapping := VolumeMapping{SDCID: m[1], IP: m[2], Name: notAvailable(m[3])}
+			mapping.IOPSLimit, _ = strconv.Atoi(m[4])
+			mapping.BandwidthLimit, _ = strconv.Atoi(m[5])
+			volume.Mappings = append(volume.Mappings, mapping)
+		}
+	}
+	if volume == nil {
+		return nil, fmt.Errorf("Unable to parse scli --query_volume output: no volume found")
+	}
+	volume.MappedSDCs = len(volume.Mappings)
+	return volume, nil
+}
+
+//ParseQueryAll parses the protection domains and storage pools from the output of scli --query_all
+func ParseQueryAll(output string) ([]ProtectionDomainInfo, []PoolInfo, error) {
+	var domains []ProtectionDomainInfo
+	var pools []PoolInfo
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Query all returned") {
+			found = true
+		} else if m := domainLine.FindStringSubmatch(line); m != nil {
+			domain := ProtectionDomainInfo{Name: m[1], ID: m[2], Available: sizeBytes(m[7], m[8])}
+			domain.StoragePools, _ = strconv.Atoi(m[3])
+			domain.FaultSets, _ = strconv.Atoi(m[4])
+			domain.SDSs, _ = strconv.Atoi(m[5])
+			domain.Volumes, _ = strconv.Atoi(m[6])
+			domains = append(domains, domain)
+		} else if m := poolLine.FindStringSubmatch(line); m != nil && len(domains) > 0 {
+			pool := PoolInfo{Name: m[1], ID: m[2], Available: sizeBytes(m[4], m[5])}
+			pool.ProtectionDomainID, pool.ProtectionDomain = domains[len(domains)-1].ID, domains[len(domains)-1].Name
+			pool.Volumes, _ = strconv.Atoi(m[3])
+			pools = append(pools, pool)
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("Unable to parse scli --query_all output: no protection domain count found")
+	}
+	return domains, pools, nil
+}
+
+//ParseStoragePool parses the output of scli --query_storage_pool
+func ParseStoragePool(output string) (*PoolInfo, error) {
+	var pool *PoolInfo
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := poolLine.FindStringSubmatch(line); m != nil {
+			pool = &PoolInfo{Name: m[1], ID: m[2], Available: sizeBytes(m[4], m[5])}
+			pool.Volumes, _ = strconv.Atoi(m[3])
+			continue
+		}
+		if pool == nil {
+			continue
+		}
+		if m := poolDomainLine.FindStringSubmatch(line); m != nil {
+			pool.ProtectionDomainID, pool.ProtectionDomain = m[1], m[2]
+		} else if m := spareLine.FindStringSubmatch(line); m != nil {
+			pool.SparePercent, _ = strconv.Atoi(m[1])
+		} else if m := checksumLine.FindStringSubmatch(line); m != nil {
+			pool.Checksum = strings.EqualFold(m[1], "enabled")
+		} else if line == "Zero padding is enabled" {
+			pool.ZeroPadding = true
+		} else if line == "Uses RAM Read Cache" {
+			pool.RMCache = true
+		} else if m := capacityLine.FindStringSubmatch(line); m != nil {
+			switch m[3] {
+			case "total":
+				pool.Total = sizeBytes(m[1], m[2])
+			case "unused":
+				pool.Unused = sizeBytes(m[1], m[2])
+			case "in-use":
+				pool.InUse = sizeBytes(m[1], m[2])
+			}
+		}
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("Unable to parse scli --query_storage_pool output: no storage pool found")
+	}
+	return pool, nil
+}
+
+//ParseFaultSets parses the output of scli --query_all_fault_sets for one protection domain
+func ParseFaultSets(output string) ([]FaultSetInfo, error) {
+	var faultSets []FaultSetInfo
+	var domain string
+	expected := -1
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := faultSetCount.FindStringSubmatch(line); m != nil {
+			domain = m[1]
+			expected, _ = strconv.Atoi(m[2])
+		} else if m := faultSetLine.FindStringSubmatch(line); m != nil {
+			faultSets = append(faultSets, FaultSetInfo{ID: m[1], Name: notAvailable(m[2]), ProtectionDomain: domain})
+		} else if m := faultSetSDSLine.FindStringSubmatch(line); m != nil && len(faultSets) > 0 {
+			faultSet := &faultSets[len(faultSets)-1]
+			faultSet.SDSs = append(faultSet.SDSs, m[1])
+		}
+	}
+	if expected < 0 {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_fault_sets output: no fault set count found")
+	}
+	if expected != len(faultSets) {
+		return nil, fmt.Errorf("Unable to parse scli --query_all_fault_sets output: expected %v fault sets, parsed %v", expected, len(faultSets))
+	}
+	return faultSets, nil
+}
+
+//objectID finds the ID scli reports for an object it created
+func objectID(output string) (string, error) {
+	m := objectIDLine.FindStringSubmatch(output)
+	if m == nil {
+		return "", fmt.Errorf("Unable to find object ID in scli output: %v", strings.TrimSpace(output))
+	}
+	return strings.TrimSuffix(m[1], "."), nil
+}
+
+//scliFields splits "Key: value, Key: value" lines, values that are themselves comma separated lists stay together
+func scliFields(line string) map[string]string {
+	fields := map[string]string{}
+	var key string
+	for _, token := range strings.Split(line, ", ") {
+		if i := strings.Index(token, ": "); i >= 0 {
+			key = token[:i]
+			fields[key] = strings.TrimSpace(token[i+2:])
+		} else if key != "" {
+			fields[key] += ", " + token
+		}
+	}
+	return fields
+}
+
+//mdmRole maps a --query_cluster section heading to the role of the MDMs listed in it
+func mdmRole(section string) string {
+	switch section {
+	case "Master MDM":
+		return RoleMaster
+	case "Slave MDMs":
+		return RoleSlave
+	case "Tie-Breakers":
+		return RoleTieBreaker
+	case "Standby MDMs":
+		return RoleStandby
+	}
+	return ""
+}
+
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func splitList(value string) []string {
+	if value == "" || value == "N/A" {
+		return nil
+	}
+	return strings.Split(value, ", ")
+}
+
+func notAvailable(value string) string {
+	if value == "N/A" {
+		return ""
+	}
+	return value
+}
+
+//sizeBytes converts the exact size scli prints in brackets
+func sizeBytes(value string, unit string) uint64 {
+	n, _ := strconv.ParseUint(value, 10, 64)
+	switch unit {
+	case "KB":
+		return n << 10
+	case "MB":
+		return n << 20
+	case "GB":
+		return n << 30
+	case "TB":
+		return n << 40
+	}
+	return n
+}
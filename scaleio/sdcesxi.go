@@ -5,6 +5,7 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
@@ -36,13 +37,16 @@ type SDCESXi struct {
 	Hostname    string
 	SSH         sshclient.ShellConnection
 	Vcenter     *vsphere.Vcenter
+
+	factsMu sync.Mutex
+	facts   *Facts
 }
 
 //SDS finds a VM providingg the SDS if it exists.
 func (sdc *SDCESXi) SDS() (*object.VirtualMachine, error) {
 	err := sdc.Vcenter.Login()
 	if err != nil {
-		log.Print("vCenter login failed")
+		logf("vCenter login failed")
 		return nil, err
 	}
 	pc := property.DefaultCollector(sdc.Vcenter.Client.Client)
@@ -50,7 +54,7 @@ func (sdc *SDCESXi) SDS() (*object.VirtualMachine, error) {
 	var vmmorefs []types.ManagedObjectReference
 	err = sdc.HostSystem.Properties(sdc.Vcenter.Context, sdc.HostSystem.Reference(), []string{"vm"}, &vmmorefs)
 	if err != nil {
-		log.Print("Failed to retrieve ESXi hostsystem object")
+		logf("Failed to retrieve ESXi hostsystem object")
 		return nil, err
 	}
 
@@ -74,17 +78,17 @@ func (sdc *SDCESXi) SDS() (*object.VirtualMachine, error) {
 func (sdc *SDCESXi) RemoveSDS() error {
 	vm, err := sdc.SDS()
 	if err != nil {
-		log.Print("SDS VM not found")
+		logf("SDS VM not found")
 		return err
 	}
 	task, err := vm.PowerOff(sdc.Vcenter.Context)
 	if _, err = task.WaitForResult(sdc.Vcenter.Context, nil); err != nil {
-		log.Print("Could not power off VM: " + vm.Name())
+		logf("Could not power off VM: %v", vm.Name())
 		//return err
 	}
 	task, err = vm.Destroy(sdc.Vcenter.Context)
 	if _, err = task.WaitForResult(sdc.Vcenter.Context, nil); err != nil {
-		log.Print("Could not delete VM: " + vm.Name())
+		logf("Could not delete VM: %v", vm.Name())
 		return err
 	}
 	return nil
@@ -100,7 +104,7 @@ func (sdc *SDCESXi) DeployTemplate(fpath string) (*object.VirtualMachine, error)
 		return nil, err
 	}
 	if mh.Parent.Type != "ClusterComputeResource" {
-		log.Printf("Host is not in a cluster")
+		logf("Host is not in a cluster")
 		return nil, fmt.Errorf("Host is not in a cluster, cannot deploy SDS VM")
 	}
 	cluster := object.NewClusterComputeResource(sdc.Vcenter.Client.Client, mh.Parent.Reference())
@@ -188,7 +192,7 @@ func (sdc *SDCESXi) DeploySVM(template *object.VirtualMachine, sds *SDSNode) (*o
 	var vm mo.VirtualMachine
 	err = template.Properties(sdc.Vcenter.Context, template.Reference(), []string{"parent"}, &vm)
 	if err != nil {
-		log.Print("Failed to retrieve template's parent folder")
+		logf("Failed to retrieve template's parent folder")
 		return nil, err
 	}
 	folder := object.NewFolder(sdc.Vcenter.Client.Client, *vm.Parent)
@@ -206,13 +210,13 @@ func (sdc *SDCESXi) DeploySVM(template *object.VirtualMachine, sds *SDSNode) (*o
 	}
 	cloneTask, err := template.Clone(sdc.Vcenter.Context, folder, sds.Hostname, spec)
 	if _, err = cloneTask.WaitForResult(sdc.Vcenter.Context, nil); err != nil {
-		log.Print("Could not clone VM: " + sds.Hostname)
+		logf("Could not clone VM: %v", sds.Hostname)
 		return nil, err
 	}
 	var taskObject mo.Task
 	err = cloneTask.Properties(sdc.Vcenter.Context, cloneTask.Reference(), []string{"info.result"}, &taskObject)
 	if err != nil {
-		log.Print("Failed to retrieve clone task's result")
+		logf("Failed to retrieve clone task's result")
 		return nil, err
 	}
 	var newVM mo.VirtualMachine
@@ -223,23 +227,41 @@ func (sdc *SDCESXi) DeploySVM(template *object.VirtualMachine, sds *SDSNode) (*o
 	return object.NewVirtualMachine(sdc.Vcenter.Client.Client, newVM.Reference()), nil
 }
 
-//Command allows for SSH commands to be sent to the ESXI server
+//Command allows for SSH commands to be sent to the ESXI server, a non-zero exit is returned as an *sshclient.ExitError
 func (sdc *SDCESXi) Command(cmd string) (*sshclient.CommandOutput, error) {
+	return sdc.CommandContext(context.Background(), cmd)
+}
+
+//CommandContext sends an SSH command to the ESXi server that is killed if the context ends first
+func (sdc *SDCESXi) CommandContext(ctx context.Context, cmd string) (*sshclient.CommandOutput, error) {
 	// s := sshclient.NewSSHClient("sshtest", "sshtest", "localhost")
-	out, err := sdc.SSH.Command(cmd)
+	return sdc.SSH.ExecuteContext(ctx, &sshclient.Command{Command: cmd, OnStdout: printStdout})
+}
+
+//Facts returns the host's ESXi version, hardware, vmknic addresses and ScaleIO VIBs, gathered with esxcli on first use and cached
+func (sdc *SDCESXi) Facts(ctx context.Context) (*Facts, error) {
+	sdc.factsMu.Lock()
+	defer sdc.factsMu.Unlock()
+	if sdc.facts != nil {
+		return sdc.facts, nil
+	}
+	facts, err := GatherFacts(ctx, sdc.SSH)
 	if err != nil {
-		return out, err
+		return nil, fmt.Errorf("Unable to gather facts for %v: %v", sdc.Hostname, err)
+	}
+	if facts.OS != OSESXi {
+		return nil, fmt.Errorf("%v is not an ESXi host, found %v", sdc.Hostname, facts.Release.Name)
 	}
-	fmt.Println(string(out.Stdout))
-	return out, nil
+	sdc.facts = facts
+	return facts, nil
 }
 
 //UpdateScini writes values to the scini module configuration in ESXi
 func (sdc *SDCESXi) UpdateScini(mdmIP string, guid string) error {
-	if sdc.MdmIPString == "" {
+	if mdmIP == "" {
 		return fmt.Errorf("No MDM IP assigned for SDCESXi, cannot set guid without MDMIPString")
 	}
-	_, err := sdc.Command(fmt.Sprintf("esxcli system module parameters set -m scini -p 'IoctlIniGuidStr=%v IoctlMdmIPStr=%v'", mdmIP, guid))
+	_, err := sdc.Command(sshclient.Args("esxcli", "system", "module", "parameters", "set", "-m", "scini", "-p", fmt.Sprintf("IoctlIniGuidStr=%v IoctlMdmIPStr=%v", guid, mdmIP)).String())
 	if err != nil {
 		return err
 	}
@@ -254,11 +276,16 @@ func (sdc *SDCESXi) UpdateScini(mdmIP string, guid string) error {
 
 }
 
+//SDCFlags maps volumes to the host by the GUID its scini module was given in UpdateScini
+func (sdc *SDCESXi) SDCFlags() []string {
+	return SDCGUID(sdc.IniGUIDStr).SDCFlags()
+}
+
 //EnablePassthrough makes a hardware device available to VMs if it matches a name pattern
 func (sdc *SDCESXi) EnablePassthrough(devname string) error {
 	err := sdc.Vcenter.Login()
 	if err != nil {
-		log.Print("vCenter login failed")
+		logf("vCenter login failed")
 		return err
 	}
 	//defer sdc.Vcenter.Logout()
@@ -270,11 +297,11 @@ func (sdc *SDCESXi) EnablePassthrough(devname string) error {
 	//no govmomi support for the pcpassthrusystem objects so gotta get the underlying managed objects
 	err = sdc.HostSystem.Properties(ctx, sdc.HostSystem.Reference(), []string{"configManager.pciPassthruSystem", "hardware.pciDevice"}, &h)
 	if err != nil {
-		log.Print("Failed to retrieve ESXi hostsystem object")
+		logf("Failed to retrieve ESXi hostsystem object")
 		return err
 	}
 	passthrough := h.ConfigManager.PciPassthruSystem
-	log.Printf("Passthrough data: %+v", passthrough.Reference())
+	logf("Passthrough data: %+v", passthrough.Reference())
 	list := []types.ManagedObjectReference{*passthrough}
 
 	// log.Printf("View: %+v", v)
@@ -289,10 +316,10 @@ func (sdc *SDCESXi) EnablePassthrough(devname string) error {
 	for _, dev := range passthroughSystem.PciPassthruInfo {
 		info := dev.GetHostPciPassthruInfo()
 		if info.PassthruEnabled {
-			log.Printf("PCI pass through already enabled: %+v", info)
+			logf("PCI pass through already enabled: %+v", info)
 		}
 		if info.PassthruActive {
-			log.Printf("PCI pass through already active: %+v", info)
+			logf("PCI pass through already active: %+v", info)
 			return nil
 		}
 	}
@@ -301,7 +328,7 @@ func (sdc *SDCESXi) EnablePassthrough(devname string) error {
 	for _, dev := range h.Hardware.PciDevice {
 		if strings.Contains(dev.VendorName, devname) {
 			targetDev = dev
-			log.Printf("Found target device with name: '%v' and model: '%v'", dev.VendorName, dev.DeviceName)
+			logf("Found target device with name: '%v' and model: '%v'", dev.VendorName, dev.DeviceName)
 		}
 	}
 	// hostpciconfigitem := types.HostPciPassthruConfig{Id: targetDev.Id, PassthruEnabled: true}
@@ -324,7 +351,7 @@ func (sdc *SDCESXi) EnablePassthrough(devname string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Config response: %+v", res)
+	logf("Config response: %+v", res)
 
 	return nil
 }
@@ -396,7 +423,7 @@ func (sdc *SDCESXi) deployVnics() error {
 					}
 				}
 				if hostfound == false {
-					log.Printf("Host: '%v' is not found on DVS: '%v'", sdc.HostSystem.Name(), dvs.Name)
+					logf("Host: '%v' is not found on DVS: '%v'", sdc.HostSystem.Name(), dvs.Name)
 					return fmt.Errorf("Host: '%v' is not found on DVS: '%v'", sdc.HostSystem.Name(), dvs.Name)
 				}
 				portgroupfound := false
@@ -427,10 +454,10 @@ func (sdc *SDCESXi) deployVnics() error {
 				}
 				result, err := networkSystemobj.AddVirtualNic(ctx, "", hostVirtualNicSpec)
 				if err != nil {
-					log.Printf("Error adding VNIC '%v' to vSwitch", targetPortgroup+"-vnic")
+					logf("Error adding VNIC '%v' to vSwitch", targetPortgroup+"-vnic")
 					return err
 				}
-				log.Printf("Virtual NIC response: %v", result)
+				logf("Virtual NIC response: %v", result)
 			}
 			if dvsfound == false {
 				return fmt.Errorf("DVS: '%v' was not found on this vCenter", network.Dvs)
@@ -450,11 +477,11 @@ func (sdc *SDCESXi) deployVnics() error {
 					//vnicfound := false
 					for _, vnic := range networkSystem.NetworkInfo.Vnic {
 						if vnic.Portgroup == targetPortgroup {
-							log.Printf("VNIC already exists on portgroup '%v'", vnic.Portgroup)
+							logf("VNIC already exists on portgroup '%v'", vnic.Portgroup)
 							networkSystemobj.RemoveVirtualNic(ctx, vnic.Device)
 						}
 						if vnic.Portgroup == targetPortgroup+"-vnic" {
-							log.Printf("VNIC already exists on portgroup '%v'", vnic.Portgroup)
+							logf("VNIC already exists on portgroup '%v'", vnic.Portgroup)
 							networkSystemobj.RemoveVirtualNic(ctx, vnic.Device)
 							networkSystemobj.RemovePortGroup(ctx, targetPortgroup+"-vnic")
 						}
@@ -477,10 +504,10 @@ func (sdc *SDCESXi) deployVnics() error {
 				}
 				result, err := networkSystemobj.AddVirtualNic(ctx, targetPortgroup+"-vnic", hostVirtualNicSpec)
 				if err != nil {
-					log.Printf("Error adding VNIC '%v' to DVS", targetPortgroup+"-vnic")
+					logf("Error adding VNIC '%v' to DVS", targetPortgroup+"-vnic")
 					return err
 				}
-				log.Printf("Virtual NIC response: %v", result)
+				logf("Virtual NIC response: %v", result)
 			}
 
 		}
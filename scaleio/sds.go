@@ -0,0 +1,228 @@
+package scaleio
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//sdsPollInterval is how often a new SDS is queried while waiting for it to connect
+var sdsPollInterval = 5 * time.Second
+
+//AddSDS registers the SDS with the MDM using its data IPs, protection domain and fault set, waits for it to connect
+//and adds its devices, skipping any it already has. An SDS already registered under the node's hostname is reused
+//if it is in the same protection domain and fault set.
+//The SDS ID is returned and kept in sds.ID.
+func (cluster *Cluster) AddSDS(sds *SDSNode) (string, error) {
+	if sds.ProtectionDomain == "" {
+		return "", fmt.Errorf("Unable to add SDS %v: no protection domain set", sds.Hostname)
+	}
+	err := cluster.login()
+	if err != nil {
+		return "", err
+	}
+	existing, err := cluster.sdsByName(sds.Hostname)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	if existing != nil {
+		if existing.ProtectionDomain != sds.ProtectionDomain {
+			return "", fmt.Errorf("Unable to add SDS %v: already registered in protection domain %v, not %v", sds.Hostname, existing.ProtectionDomain, sds.ProtectionDomain)
+		}
+		if sds.FaultSet != "" {
+			//--query_all_sds does not show fault sets
+			info, err := cluster.querySDS(context.Background(), existing.ID)
+			if err != nil {
+				return "", err
+			}
+			if info.FaultSet != sds.FaultSet {
+				faultSet := info.FaultSet
+				if faultSet == "" {
+					faultSet = "none"
+				}
+				return "", fmt.Errorf("Unable to add SDS %v: already registered in fault set %v, not %v", sds.Hostname, faultSet, sds.FaultSet)
+			}
+		}
+		id = existing.ID
+		logf("SDS %v is already registered with ID %v", sds.Hostname, id)
+	} else {
+		args := []string{"--mdm_ip=" + cluster.mdmIP(), "--add_sds", "--sds_ip", sds.DataIPString(), "--sds_name", sds.Hostname, "--protection_domain_name", sds.ProtectionDomain}
+		if sds.FaultSet != "" {
+			args = append(args, "--fault_set_name", sds.FaultSet)
+		}
+		output, err := cluster.scli(args...)
+		if err != nil {
+			return "", err
+		}
+		id, err = objectID(output.Stdout)
+		if err != nil {
+			return "", err
+		}
+		logf("Added SDS %v with ID %v", sds.Hostname, id)
+	}
+	sds.ID = id
+	info, err := cluster.waitForSDS(id)
+	if err != nil {
+		return id, err
+	}
+	err = cluster.addDevices(sds, info, sds.Devices)
+	if err != nil {
+		return id, err
+	}
+	for _, known := range cluster.SDSs {
+		if known == sds {
+			return id, nil
+		}
+	}
+	cluster.SDSs = append(cluster.SDSs, sds)
+	return id, nil
+}
+
+//AddSDSDevices adds devices to an SDS already in the cluster, skipping any it already has, and records them in sds.Devices
+func (cluster *Cluster) AddSDSDevices(sds *SDSNode, devices ...SDSDevice) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	info, err := cluster.sdsInfo(sds)
+	if err != nil {
+		return err
+	}
+	err = cluster.addDevices(sds, info, devices)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if sds.device(device.Path) < 0 {
+			sds.Devices = append(sds.Devices, device)
+		}
+	}
+	return nil
+}
+
+//RemoveSDSDevices removes devices from an SDS by path, paths the SDS does not have are skipped.
+//ScaleIO rebuilds the data held on them elsewhere before they are gone.
+func (cluster *Cluster) RemoveSDSDevices(sds *SDSNode, paths ...string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	info, err := cluster.sdsInfo(sds)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if i := sds.device(path); i >= 0 {
+			sds.Devices = append(sds.Devices[:i], sds.Devices[i+1:]...)
+		}
+		if info.Device(path) == nil {
+			logf("SDS %v has no device %v, nothing to remove", sds.Hostname, path)
+			continue
+		}
+		_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--remove_sds_device", "--sds_id", sds.ID, "--device_path", path)
+		if err != nil {
+			return err
+		}
+		logf("Removed device %v from SDS %v", path, sds.Hostname)
+	}
+	return nil
+}
+
+//addDevices adds the devices the SDS does not have yet
+func (cluster *Cluster) addDevices(sds *SDSNode, info *SDSInfo, devices []SDSDevice) error {
+	for _, device := range devices {
+		if info.Device(device.Path) != nil {
+			logf("SDS %v already has device %v", sds.Hostname, device.Path)
+			continue
+		}
+		if device.StoragePool == "" {
+			return fmt.Errorf("Unable to add device %v to SDS %v: no storage pool set", device.Path, sds.Hostname)
+		}
+		args := []string{"--mdm_ip=" + cluster.mdmIP(), "--add_sds_device", "--sds_id", sds.ID, "--device_path", device.Path, "--storage_pool_name", device.StoragePool}
+		if device.Name != "" {
+			args = append(args, "--device_name", device.Name)
+		}
+		_, err := cluster.scli(args...)
+		if err != nil {
+			return err
+		}
+		logf("Added device %v to SDS %v in storage pool %v", device.Path, sds.Hostname, device.StoragePool)
+	}
+	return nil
+}
+
+//sdsInfo queries an SDS, looking its ID up by hostname if it is not known yet
+func (cluster *Cluster) sdsInfo(sds *SDSNode) (*SDSInfo, error) {
+	if sds.ID == "" {
+		existing, err := cluster.sdsByName(sds.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, fmt.Errorf("SDS %v is not registered with the MDM", sds.Hostname)
+		}
+		sds.ID = existing.ID
+	}
+	return cluster.querySDS(cluster.context(), sds.ID)
+}
+
+//sdsByName finds a registered SDS by name, nil if there is none
+func (cluster *Cluster) sdsByName(name string) (*SDSInfo, error) {
+	output, err := cluster.query("--query_all_sds")
+	if err != nil {
+		return nil, err
+	}
+	sdss, err := ParseSDSList(output)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sdss {
+		if sdss[i].Name == name {
+			return &sdss[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (cluster *Cluster) querySDS(ctx context.Context, id string) (*SDSInfo, error) {
+	output, err := cluster.queryContext(ctx, "--query_sds", "--sds_id", id)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSDS(output)
+}
+
+//waitForSDS polls the SDS until the MDM reports it connected or the connect timeout passes
+func (cluster *Cluster) waitForSDS(id string) (*SDSInfo, error) {
+	timeout := 5 * time.Minute
+	if cluster.Options != nil && cluster.Options.SDSConnectTimeout > 0 {
+		timeout = cluster.Options.SDSConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(cluster.context(), timeout)
+	defer cancel()
+	for {
+		info, err := cluster.querySDS(ctx, id)
+		if err == nil && info.State == "Connected" {
+			return info, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("connection state is %v", info.State)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("SDS %v did not connect within %v: %v", id, timeout, err)
+		case <-time.After(sdsPollInterval):
+		}
+	}
+}
+
+//device returns the index of the device with the path in sds.Devices, -1 if it is not there
+func (sds *SDSNode) device(path string) int {
+	for i, device := range sds.Devices {
+		if device.Path == path {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,6 +1,7 @@
 package scaleio
 
 import (
+	"context"
 	"net"
 
 	"github.com/howels/infra-tools/ssh"
@@ -9,16 +10,27 @@ import (
 //SDSNode describes the properties of the VM to be built
 type SDSNode struct {
 	*Node
+	ProtectionDomain string      //the protection domain the SDS joins
+	FaultSet         string      //optional fault set within the protection domain
+	Devices          []SDSDevice //storage devices added to the SDS
+	ID               string      //the SDS ID, set once the SDS is added to a cluster
 }
 
-//NewSDSNode passes a new node object
-func NewSDSNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool) *SDSNode {
+//SDSDevice is a block device an SDS contributes to a storage pool
+type SDSDevice struct {
+	Path        string
+	StoragePool string
+	Name        string //optional, scli shows N/A when empty
+}
+
+//NewSDSNode passes a new node object, options configure SSH auth
+func NewSDSNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, options ...sshclient.Option) *SDSNode {
 
 	ip, _, err := net.ParseCIDR(ManagementCIDR)
 	if err != nil {
 		panic(err)
 	}
-	sshClient := sshclient.NewSSHClient(Username, Password, ip.String())
+	sshClient := sshclient.NewSSHClient(Username, Password, ip.String(), options...)
 	var Become string
 	if UseSudo {
 		Become = "sudo bash -c "
@@ -32,11 +44,17 @@ func NewSDSNode(Username string, Password string, Hostname string, DataCIDR []st
 		Become:            Become,
 	}
 	node.Installation.InstallCommands = []string{"cd /root/install && rpm -i EMC-ScaleIO-sds-*.rpm EMC-ScaleIO-lia-*.rpm"}
+	node.Installation.Packages = []string{"EMC-ScaleIO-sds", "EMC-ScaleIO-lia"}
 	return &SDSNode{Node: node}
 }
 
 //Install sets up the VM
 func (node *SDSNode) Install() error {
-	node.Commands(node.Installation.PrereqCommands)
-	return nil
+	return node.InstallContext(context.Background())
+}
+
+//InstallContext sets up the VM like any other node, skipping the erase and install commands when the SDS and LIA
+//packages are installed already
+func (node *SDSNode) InstallContext(ctx context.Context) error {
+	return node.Node.InstallContext(ctx)
 }
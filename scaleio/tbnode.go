@@ -12,14 +12,14 @@ type TBNode struct {
 	ScaleIO *ScaleIO
 }
 
-//NewTBNode passes a new node object
-func NewTBNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO) *TBNode {
+//NewTBNode passes a new node object, options configure SSH auth
+func NewTBNode(Username string, Password string, Hostname string, DataCIDR []string, ManagementCIDR string, UseSudo bool, ScaleIO *ScaleIO, options ...sshclient.Option) *TBNode {
 
 	ip, _, err := net.ParseCIDR(ManagementCIDR)
 	if err != nil {
 		panic(err)
 	}
-	sshClient := sshclient.NewSSHClient(Username, Password, ip.String())
+	sshClient := sshclient.NewSSHClient(Username, Password, ip.String(), options...)
 	var Become string
 	if UseSudo {
 		Become = "sudo bash -c "
@@ -33,5 +33,6 @@ func NewTBNode(Username string, Password string, Hostname string, DataCIDR []str
 		Become:            Become,
 	}
 	node.Installation.InstallCommands = []string{"cd /root/install && MDM_ROLE_IS_MANAGER=0 rpm -i EMC-ScaleIO-mdm-*.rp"}
+	node.Installation.Packages = []string{"EMC-ScaleIO-mdm"}
 	return &TBNode{Node: node, ScaleIO: ScaleIO}
 }
@@ -0,0 +1,328 @@
+package scaleio
+
+import (
+	"strconv"
+)
+
+//ListProtectionDomains lists the protection domains with their pool, fault set, SDS and volume counts
+func (cluster *Cluster) ListProtectionDomains() ([]ProtectionDomainInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	domains, _, err := cluster.storageTopology()
+	return domains, err
+}
+
+//CreateProtectionDomain adds a protection domain and returns its ID
+func (cluster *Cluster) CreateProtectionDomain(name string) (string, error) {
+	err := cluster.login()
+	if err != nil {
+		return "", err
+	}
+	return cluster.createProtectionDomain(name)
+}
+
+//RenameProtectionDomain renames a protection domain
+func (cluster *Cluster) RenameProtectionDomain(name string, newName string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--rename_protection_domain", "--protection_domain_name", name, "--new_name", newName)
+	return err
+}
+
+//DeleteProtectionDomain removes a protection domain, scli refuses while it still has SDS or storage pools
+func (cluster *Cluster) DeleteProtectionDomain(name string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--remove_protection_domain", "--protection_domain_name", name)
+	return err
+}
+
+//ListStoragePools lists the storage pools of every protection domain with their capacity and options
+func (cluster *Cluster) ListStoragePools() ([]PoolInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	_, pools, err := cluster.storageTopology()
+	return pools, err
+}
+
+//CreateStoragePool adds a storage pool to a protection domain, applies its options and returns its ID
+func (cluster *Cluster) CreateStoragePool(domain string, pool StoragePoolConfig) (string, error) {
+	err := cluster.login()
+	if err != nil {
+		return "", err
+	}
+	id, err := cluster.createStoragePool(domain, pool)
+	if err != nil {
+		return "", err
+	}
+	return id, cluster.configureStoragePool(domain, pool, nil)
+}
+
+//ConfigureStoragePool changes the options of an existing storage pool that differ from the config
+func (cluster *Cluster) ConfigureStoragePool(domain string, pool StoragePoolConfig) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	return cluster.configureStoragePool(domain, pool, nil)
+}
+
+//RenameStoragePool renames a storage pool within its protection domain
+func (cluster *Cluster) RenameStoragePool(domain string, name string, newName string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli(append(cluster.poolArgs("--rename_storage_pool", domain, name), "--new_name", newName)...)
+	return err
+}
+
+//DeleteStoragePool removes a storage pool, scli refuses while it still has volumes or devices
+func (cluster *Cluster) DeleteStoragePool(domain string, name string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli(cluster.poolArgs("--remove_storage_pool", domain, name)...)
+	return err
+}
+
+//ListFaultSets lists the fault sets of a protection domain with the SDS in each
+func (cluster *Cluster) ListFaultSets(domain string) ([]FaultSetInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	return cluster.faultSets(domain)
+}
+
+//CreateFaultSet adds a fault set to a protection domain and returns its ID
+func (cluster *Cluster) CreateFaultSet(domain string, name string) (string, error) {
+	err := cluster.login()
+	if err != nil {
+		return "", err
+	}
+	return cluster.createFaultSet(domain, name)
+}
+
+//RenameFaultSet renames a fault set within its protection domain
+func (cluster *Cluster) RenameFaultSet(domain string, name string, newName string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--rename_fault_set", "--protection_domain_name", domain, "--fault_set_name", name, "--new_name", newName)
+	return err
+}
+
+//DeleteFaultSet removes a fault set, scli refuses while it still has SDS
+func (cluster *Cluster) DeleteFaultSet(domain string, name string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--remove_fault_set", "--protection_domain_name", domain, "--fault_set_name", name)
+	return err
+}
+
+//ApplyTopology creates the protection domains, fault sets and storage pools that are missing and brings the
+//options of existing pools in line. Anything the cluster has beyond the topology is left alone.
+func (cluster *Cluster) ApplyTopology(topology Topology) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	domains, pools, err := cluster.storageTopology()
+	if err != nil {
+		return err
+	}
+	for _, domain := range topology.ProtectionDomains {
+		if !hasDomain(domains, domain.Name) {
+			if _, err := cluster.createProtectionDomain(domain.Name); err != nil {
+				return err
+			}
+		}
+		if len(domain.FaultSets) > 0 {
+			existing, err := cluster.faultSets(domain.Name)
+			if err != nil {
+				return err
+			}
+			for _, name := range domain.FaultSets {
+				if hasFaultSet(existing, name) {
+					continue
+				}
+				if _, err := cluster.createFaultSet(domain.Name, name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, pool := range domain.StoragePools {
+			current := findPool(pools, domain.Name, pool.Name)
+			if current == nil {
+				if _, err := cluster.createStoragePool(domain.Name, pool); err != nil {
+					return err
+				}
+			}
+			if err := cluster.configureStoragePool(domain.Name, pool, current); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//storageTopology reads the protection domains and storage pools, with each pool's capacity and options
+func (cluster *Cluster) storageTopology() ([]ProtectionDomainInfo, []PoolInfo, error) {
+	output, err := cluster.query("--query_all")
+	if err != nil {
+		return nil, nil, err
+	}
+	domains, pools, err := ParseQueryAll(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range pools {
+		output, err = cluster.query("--query_storage_pool", "--storage_pool_id", pools[i].ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool, err := ParseStoragePool(output)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool.ProtectionDomainID, pool.ProtectionDomain = pools[i].ProtectionDomainID, pools[i].ProtectionDomain
+		pools[i] = *pool
+	}
+	return domains, pools, nil
+}
+
+func (cluster *Cluster) createProtectionDomain(name string) (string, error) {
+	output, err := cluster.scli("--mdm_ip="+cluster.mdmIP(), "--add_protection_domain", "--protection_domain_name", name)
+	if err != nil {
+		return "", err
+	}
+	logf("Created protection domain %v", name)
+	return objectID(output.Stdout)
+}
+
+//createStoragePool adds the pool with its zero padding policy, which cannot be changed once devices are added
+func (cluster *Cluster) createStoragePool(domain string, pool StoragePoolConfig) (string, error) {
+	args := cluster.poolArgs("--add_storage_pool", domain, pool.Name)
+	if pool.ZeroPadding != nil {
+		args = append(args, "--zero_padding_policy", enableDisable(*pool.ZeroPadding))
+	}
+	output, err := cluster.scli(args...)
+	if err != nil {
+		return "", err
+	}
+	logf("Created storage pool %v in protection domain %v", pool.Name, domain)
+	return objectID(output.Stdout)
+}
+
+//configureStoragePool changes the options that differ from the current pool, which is queried when nil
+func (cluster *Cluster) configureStoragePool(domain string, pool StoragePoolConfig, current *PoolInfo) error {
+	if current == nil {
+		output, err := cluster.query("--query_storage_pool", "--protection_domain_name", domain, "--storage_pool_name", pool.Name)
+		if err != nil {
+			return err
+		}
+		current, err = ParseStoragePool(output)
+		if err != nil {
+			return err
+		}
+	}
+	var changes [][]string
+	if pool.SparePercent != 0 && pool.SparePercent != current.SparePercent {
+		changes = append(changes, append(cluster.poolArgs("--modify_spare_policy", domain, pool.Name), "--spare_percentage", strconv.Itoa(pool.SparePercent), "--i_am_sure"))
+	}
+	if pool.ZeroPadding != nil && *pool.ZeroPadding != current.ZeroPadding {
+		changes = append(changes, append(cluster.poolArgs("--modify_zero_padding_policy", domain, pool.Name), "--zero_padding_policy", enableDisable(*pool.ZeroPadding)))
+	}
+	if pool.RMCache != nil && *pool.RMCache != current.RMCache {
+		flag := "--dont_use_rmcache"
+		if *pool.RMCache {
+			flag = "--use_rmcache"
+		}
+		changes = append(changes, append(cluster.poolArgs("--set_rmcache_usage", domain, pool.Name), flag, "--i_am_sure"))
+	}
+	if pool.Checksum != nil && *pool.Checksum != current.Checksum {
+		action := "--disable_checksum"
+		if *pool.Checksum {
+			action = "--enable_checksum"
+		}
+		changes = append(changes, cluster.poolArgs(action, domain, pool.Name))
+	}
+	for _, args := range changes {
+		if _, err := cluster.scli(args...); err != nil {
+			return err
+		}
+	}
+	if len(changes) > 0 {
+		logf("Updated %v options of storage pool %v in protection domain %v", len(changes), pool.Name, domain)
+	}
+	return nil
+}
+
+func (cluster *Cluster) faultSets(domain string) ([]FaultSetInfo, error) {
+	output, err := cluster.query("--query_all_fault_sets", "--protection_domain_name", domain)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFaultSets(output)
+}
+
+func (cluster *Cluster) createFaultSet(domain string, name string) (string, error) {
+	output, err := cluster.scli("--mdm_ip="+cluster.mdmIP(), "--add_fault_set", "--protection_domain_name", domain, "--fault_set_name", name)
+	if err != nil {
+		return "", err
+	}
+	logf("Created fault set %v in protection domain %v", name, domain)
+	return objectID(output.Stdout)
+}
+
+//poolArgs is an scli action on a storage pool named within its protection domain
+func (cluster *Cluster) poolArgs(action string, domain string, name string) []string {
+	return []string{"--mdm_ip=" + cluster.mdmIP(), action, "--protection_domain_name", domain, "--storage_pool_name", name}
+}
+
+func enableDisable(enable bool) string {
+	if enable {
+		return "enable"
+	}
+	return "disable"
+}
+
+func hasDomain(domains []ProtectionDomainInfo, name string) bool {
+	for _, domain := range domains {
+		if domain.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFaultSet(faultSets []FaultSetInfo, name string) bool {
+	for _, faultSet := range faultSets {
+		if faultSet.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func findPool(pools []PoolInfo, domain string, name string) *PoolInfo {
+	for i := range pools {
+		if pools[i].ProtectionDomain == domain && pools[i].Name == name {
+			return &pools[i]
+		}
+	}
+	return nil
+}
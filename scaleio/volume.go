@@ -0,0 +1,242 @@
+package scaleio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//VolumeConfig describes a volume to create
+type VolumeConfig struct {
+	Name             string
+	ProtectionDomain string
+	StoragePool      string
+	SizeGB           int  //ScaleIO rounds up to a multiple of 8 GB
+	Thin             bool //thick provisioned unless set
+}
+
+//SDCTarget names the SDC a volume is mapped to
+type SDCTarget interface {
+	SDCFlags() []string
+}
+
+//SDCGUID is an SDC identified by its GUID, the IniGuidStr of its scini module on ESXi
+type SDCGUID string
+
+//SDCFlags selects the SDC by GUID
+func (guid SDCGUID) SDCFlags() []string {
+	return []string{"--sdc_guid", string(guid)}
+}
+
+//SDCIP is an SDC identified by one of its data IPs
+type SDCIP string
+
+//SDCFlags selects the SDC by IP
+func (ip SDCIP) SDCFlags() []string {
+	return []string{"--sdc_ip", string(ip)}
+}
+
+//CreateVolume creates a volume in a storage pool and returns it, a volume of the same name in the pool is returned as is
+func (cluster *Cluster) CreateVolume(volume VolumeConfig) (*VolumeInfo, error) {
+	if volume.SizeGB <= 0 {
+		return nil, fmt.Errorf("Unable to create volume %v: size must be at least 1 GB", volume.Name)
+	}
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := cluster.volumeByName(volume.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.ProtectionDomain != volume.ProtectionDomain || existing.StoragePool != volume.StoragePool {
+			return nil, fmt.Errorf("Unable to create volume %v: it already exists in %v/%v", volume.Name, existing.ProtectionDomain, existing.StoragePool)
+		}
+		logf("Volume %v already exists with ID %v", volume.Name, existing.ID)
+		return cluster.queryVolume(existing.ID)
+	}
+	provisioning := "--thick_provisioned"
+	if volume.Thin {
+		provisioning = "--thin_provisioned"
+	}
+	output, err := cluster.scli(append(cluster.poolArgs("--add_volume", volume.ProtectionDomain, volume.StoragePool),
+		"--volume_name", volume.Name, "--size_gb", strconv.Itoa(volume.SizeGB), provisioning)...)
+	if err != nil {
+		return nil, err
+	}
+	id, err := objectID(output.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	logf("Created volume %v with ID %v", volume.Name, id)
+	return cluster.queryVolume(id)
+}
+
+//Volume returns a volume with the SDCs it is mapped to
+func (cluster *Cluster) Volume(id string) (*VolumeInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	return cluster.queryVolume(id)
+}
+
+//VolumeByName finds a volume by name, nil if there is none
+func (cluster *Cluster) VolumeByName(name string) (*VolumeInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := cluster.volumeByName(name)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	return cluster.queryVolume(existing.ID)
+}
+
+//ResizeVolume grows a volume to the new size, ScaleIO cannot shrink volumes
+func (cluster *Cluster) ResizeVolume(id string, sizeGB int) (*VolumeInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	current, err := cluster.queryVolume(id)
+	if err != nil {
+		return nil, err
+	}
+	if size := uint64(sizeGB) << 30; size < current.Size {
+		return nil, fmt.Errorf("Unable to resize volume %v to %v GB: it is already %v GB and cannot shrink", current.Name, sizeGB, current.Size>>30)
+	} else if size == current.Size {
+		return current, nil
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--modify_volume_capacity", "--volume_id", id, "--size_gb", strconv.Itoa(sizeGB))
+	if err != nil {
+		return nil, err
+	}
+	return cluster.queryVolume(id)
+}
+
+//SnapshotVolume takes a snapshot of a volume and returns the snapshot, which is itself a volume
+func (cluster *Cluster) SnapshotVolume(id string, name string) (*VolumeInfo, error) {
+	err := cluster.login()
+	if err != nil {
+		return nil, err
+	}
+	output, err := cluster.scli("--mdm_ip="+cluster.mdmIP(), "--snapshot_volume", "--volume_id", id, "--snapshot_name", name)
+	if err != nil {
+		return nil, err
+	}
+	m := snapshotLine.FindStringSubmatch(output.Stdout)
+	if m == nil {
+		return nil, fmt.Errorf("Unable to find snapshot ID in scli output: %v", output.Stdout)
+	}
+	logf("Snapshot %v of volume %v has ID %v", name, id, m[1])
+	return cluster.queryVolume(m[1])
+}
+
+//MapVolume maps a volume to an SDC, more than one SDC may map the same volume
+func (cluster *Cluster) MapVolume(id string, sdc SDCTarget) error {
+	flags, err := sdcFlags(sdc)
+	if err != nil {
+		return err
+	}
+	err = cluster.login()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--mdm_ip=" + cluster.mdmIP(), "--map_volume_to_sdc", "--volume_id", id, "--allow_multi_map"}, flags...)
+	_, err = cluster.scli(args...)
+	if err != nil {
+		return err
+	}
+	logf("Mapped volume %v to SDC %v", id, flags[1])
+	return nil
+}
+
+//UnmapVolume removes the mapping of a volume to an SDC
+func (cluster *Cluster) UnmapVolume(id string, sdc SDCTarget) error {
+	flags, err := sdcFlags(sdc)
+	if err != nil {
+		return err
+	}
+	err = cluster.login()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--mdm_ip=" + cluster.mdmIP(), "--unmap_volume_from_sdc", "--volume_id", id, "--i_am_sure"}, flags...)
+	_, err = cluster.scli(args...)
+	if err != nil {
+		return err
+	}
+	logf("Unmapped volume %v from SDC %v", id, flags[1])
+	return nil
+}
+
+//SetVolumeLimits limits the IOPS and bandwidth, in KB per second, an SDC may use on a mapped volume. 0 removes a limit.
+func (cluster *Cluster) SetVolumeLimits(id string, sdc SDCTarget, iops int, bandwidthKB int) error {
+	flags, err := sdcFlags(sdc)
+	if err != nil {
+		return err
+	}
+	err = cluster.login()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"--mdm_ip=" + cluster.mdmIP(), "--set_sdc_volume_limits", "--volume_id", id,
+		"--limit_iops", strconv.Itoa(iops), "--limit_bandwidth", strconv.Itoa(bandwidthKB)}, flags...)
+	_, err = cluster.scli(args...)
+	return err
+}
+
+//DeleteVolume removes a volume, scli refuses while it is still mapped to an SDC
+func (cluster *Cluster) DeleteVolume(id string) error {
+	err := cluster.login()
+	if err != nil {
+		return err
+	}
+	_, err = cluster.scli("--mdm_ip="+cluster.mdmIP(), "--remove_volume", "--volume_id", id, "--i_am_sure")
+	if err != nil {
+		return err
+	}
+	logf("Deleted volume %v", id)
+	return nil
+}
+
+func (cluster *Cluster) queryVolume(id string) (*VolumeInfo, error) {
+	output, err := cluster.query("--query_volume", "--volume_id", id)
+	if err != nil {
+		return nil, err
+	}
+	return ParseVolume(output)
+}
+
+//volumeByName finds a volume in scli --query_all_volumes, nil if there is none
+func (cluster *Cluster) volumeByName(name string) (*VolumeInfo, error) {
+	output, err := cluster.query("--query_all_volumes")
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := ParseVolumes(output)
+	if err != nil {
+		return nil, err
+	}
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return &volumes[i], nil
+		}
+	}
+	return nil, nil
+}
+
+//sdcFlags checks the target names an SDC, an ESXi host without a GUID set yet would otherwise fail inside scli
+func sdcFlags(sdc SDCTarget) ([]string, error) {
+	flags := sdc.SDCFlags()
+	if len(flags) != 2 {
+		return nil, fmt.Errorf("SDC target must give one scli flag and its value, got %v", flags)
+	}
+	if flags[1] == "" {
+		return nil, fmt.Errorf("SDC target has no %v set", strings.ToUpper(strings.TrimPrefix(flags[0], "--sdc_")))
+	}
+	return flags, nil
+}
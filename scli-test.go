@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/howels/infra-tools/scaleio"
+)
+
+//parsers maps the prefix of a captured scli or facts script output file in scaleio/testdata to the parser for it, longest prefixes first
+var parsers = []struct {
+	prefix string
+	parse  func(output string) (interface{}, error)
+}{
+	{"query_all_sds", func(output string) (interface{}, error) { return scaleio.ParseSDSList(output) }},
+	{"query_all_fault_sets", func(output string) (interface{}, error) { return scaleio.ParseFaultSets(output) }},
+	{"query_all_volumes", func(output string) (interface{}, error) { return scaleio.ParseVolumes(output) }},
+	{"query_all", func(output string) (interface{}, error) {
+		domains, pools, err := scaleio.ParseQueryAll(output)
+		return map[string]interface{}{"ProtectionDomains": domains, "Pools": pools}, err
+	}},
+	{"query_cluster", func(output string) (interface{}, error) { return scaleio.ParseClusterState(output) }},
+	{"query_sds", func(output string) (interface{}, error) { return scaleio.ParseSDS(output) }},
+	{"query_volume", func(output string) (interface{}, error) { return scaleio.ParseVolume(output) }},
+	{"query_storage_pool", func(output string) (interface{}, error) { return scaleio.ParseStoragePool(output) }},
+	{"facts_linux", func(output string) (interface{}, error) { return scaleio.ParseLinuxFacts(output) }},
+	{"facts_esxi", func(output string) (interface{}, error) { return scaleio.ParseESXiFacts(output) }},
+}
+
+func main() {
+	update := flag.Bool("update", false, "rewrite the golden files from the current parsers")
+	dir := flag.String("testdata", "scaleio/testdata", "directory of captured scli output")
+	flag.Parse()
+
+	captures, err := filepath.Glob(filepath.Join(*dir, "*.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(captures) == 0 {
+		log.Fatalf("No captured scli output found in %v", *dir)
+	}
+	failed := 0
+	for _, capture := range captures {
+		if err := check(capture, *update); err != nil {
+			failed++
+			log.Printf("FAIL %v: %v", filepath.Base(capture), err)
+			continue
+		}
+		log.Printf("ok   %v", filepath.Base(capture))
+	}
+	if failed > 0 {
+		log.Printf("%v of %v captures failed", failed, len(captures))
+		os.Exit(1)
+	}
+	log.Printf("All %v captures match their golden files", len(captures))
+}
+
+//check parses a capture and compares the result, as indented JSON, with the .golden.json file beside it
+func check(capture string, update bool) error {
+	name := strings.TrimSuffix(filepath.Base(capture), ".txt")
+	var parse func(string) (interface{}, error)
+	for _, p := range parsers {
+		if strings.HasPrefix(name, p.prefix) {
+			parse = p.parse
+			break
+		}
+	}
+	if parse == nil {
+		return fmt.Errorf("no parser for %v", name)
+	}
+	output, err := ioutil.ReadFile(capture)
+	if err != nil {
+		return err
+	}
+	parsed, err := parse(string(output))
+	if err != nil {
+		return err
+	}
+	got, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return err
+	}
+	got = append(got, '\n')
+	golden := strings.TrimSuffix(capture, ".txt") + ".golden.json"
+	if update {
+		return ioutil.WriteFile(golden, got, 0644)
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("parsed output differs from %v:\n%s", filepath.Base(golden), got)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package sshclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//AuthType names one of the authentication methods an SSHClient can offer
+type AuthType string
+
+const (
+	//AuthPassword sends the client password
+	AuthPassword AuthType = "password"
+	//AuthPublicKey offers the private keys loaded with WithPrivateKey or WithPrivateKeyFile
+	AuthPublicKey AuthType = "publickey"
+	//AuthAgent offers the keys held by the ssh-agent listening on SSH_AUTH_SOCK
+	AuthAgent AuthType = "agent"
+	//AuthKeyboardInteractive answers keyboard-interactive challenges
+	AuthKeyboardInteractive AuthType = "keyboard-interactive"
+)
+
+//DefaultAuthOrder is the order methods are tried in unless WithAuthOrder is used.
+//Methods that have not been configured on the client are skipped.
+var DefaultAuthOrder = []AuthType{AuthAgent, AuthPublicKey, AuthKeyboardInteractive, AuthPassword}
+
+//Option configures an SSHClient at construction time
+type Option func(*SSHClient)
+
+type privateKey struct {
+	path       string
+	pem        []byte
+	passphrase string
+}
+
+//WithPrivateKeyFile adds a PEM or OpenSSH private key file, the passphrase is only used for encrypted keys
+func WithPrivateKeyFile(path string, passphrase string) Option {
+	return func(s *SSHClient) {
+		s.keys = append(s.keys, privateKey{path: path, passphrase: passphrase})
+	}
+}
+
+//WithPrivateKey adds an in-memory PEM or OpenSSH private key, the passphrase is only used for encrypted keys
+func WithPrivateKey(pem []byte, passphrase string) Option {
+	return func(s *SSHClient) {
+		s.keys = append(s.keys, privateKey{pem: pem, passphrase: passphrase})
+	}
+}
+
+//WithAgent authenticates using the keys of the ssh-agent found via SSH_AUTH_SOCK
+func WithAgent() Option {
+	return func(s *SSHClient) {
+		s.useAgent = true
+	}
+}
+
+//WithAgentForwarding authenticates with the local ssh-agent and forwards it to every remote session
+func WithAgentForwarding() Option {
+	return func(s *SSHClient) {
+		s.useAgent = true
+		s.forwardAgent = true
+	}
+}
+
+//WithKeyboardInteractive enables keyboard-interactive auth. A nil challenge answers every question with the client password.
+func WithKeyboardInteractive(challenge ssh.KeyboardInteractiveChallenge) Option {
+	return func(s *SSHClient) {
+		s.keyboardInteractive = true
+		s.challenge = challenge
+	}
+}
+
+//WithAuthOrder sets the order in which the configured methods are offered to the server
+func WithAuthOrder(order ...AuthType) Option {
+	return func(s *SSHClient) {
+		s.authOrder = order
+	}
+}
+
+//NewSSHClientWithKey is a constructor for key-only hosts
+func NewSSHClientWithKey(username string, keyFile string, passphrase string, hostname string, options ...Option) *SSHClient {
+	options = append([]Option{WithPrivateKeyFile(keyFile, passphrase)}, options...)
+	return NewSSHClient(username, "", hostname, options...)
+}
+
+func (k privateKey) signer() (ssh.Signer, error) {
+	data := k.pem
+	if k.path != "" {
+		var err error
+		data, err = ioutil.ReadFile(k.path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read private key %v: %v", k.path, err)
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if k.passphrase == "" {
+			return nil, fmt.Errorf("Private key %v is encrypted and no passphrase was given", k.path)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(k.passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key %v: %v", k.path, err)
+	}
+	return signer, nil
+}
+
+func (s *SSHClient) agentClient() (agent.ExtendedAgent, error) {
+	if s.agent != nil {
+		return s.agent, nil
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH agent requested but SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to SSH agent: %v", err)
+	}
+	s.agentConn = conn
+	s.agent = agent.NewClient(conn)
+	return s.agent, nil
+}
+
+//authMethods builds the ssh.AuthMethod list in the configured order.
+//Agent and key file signers share one publickey method because the ssh package only tries each method name once.
+func (s *SSHClient) authMethods() ([]ssh.AuthMethod, error) {
+	order := s.authOrder
+	if len(order) == 0 {
+		order = DefaultAuthOrder
+	}
+	var methods []ssh.AuthMethod
+	var signers []ssh.Signer
+	var agentSigners func() ([]ssh.Signer, error)
+	publicKeyAdded := false
+	addPublicKey := func() {
+		if publicKeyAdded {
+			return
+		}
+		publicKeyAdded = true
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var all []ssh.Signer
+			for _, auth := range order {
+				switch {
+				case auth == AuthAgent && agentSigners != nil:
+					fromAgent, err := agentSigners()
+					if err != nil {
+						return nil, err
+					}
+					all = append(all, fromAgent...)
+				case auth == AuthPublicKey:
+					all = append(all, signers...)
+				}
+			}
+			return all, nil
+		}))
+	}
+
+	for _, auth := range order {
+		switch auth {
+		case AuthPassword:
+			if s.pass != "" {
+				methods = append(methods, ssh.Password(s.pass))
+			}
+		case AuthPublicKey:
+			if len(s.keys) == 0 {
+				continue
+			}
+			for _, key := range s.keys {
+				signer, err := key.signer()
+				if err != nil {
+					return nil, err
+				}
+				signers = append(signers, signer)
+			}
+			addPublicKey()
+		case AuthAgent:
+			if !s.useAgent {
+				continue
+			}
+			a, err := s.agentClient()
+			if err != nil {
+				return nil, err
+			}
+			agentSigners = a.Signers
+			addPublicKey()
+		case AuthKeyboardInteractive:
+			if !s.keyboardInteractive {
+				continue
+			}
+			challenge := s.challenge
+			if challenge == nil {
+				challenge = s.passwordChallenge
+			}
+			methods = append(methods, ssh.KeyboardInteractive(challenge))
+		default:
+			return nil, fmt.Errorf("Unknown SSH auth method: %v", auth)
+		}
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("No SSH auth methods configured for %v@%v", s.user, s.host)
+	}
+	return methods, nil
+}
+
+//passwordChallenge answers every keyboard-interactive question with the client password
+func (s *SSHClient) passwordChallenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i := range questions {
+		answers[i] = s.pass
+	}
+	return answers, nil
+}
+
+//forwardAgentTo serves the local agent to the remote side of a new connection
+func (s *SSHClient) forwardAgentTo(client *ssh.Client) error {
+	if !s.forwardAgent {
+		return nil
+	}
+	a, err := s.agentClient()
+	if err != nil {
+		return err
+	}
+	if err := agent.ForwardToAgent(client, a); err != nil {
+		return fmt.Errorf("Unable to forward SSH agent: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package sshclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//BecomeMethod selects how a command obtains another user's privileges
+type BecomeMethod string
+
+const (
+	//BecomeSudo runs the command with sudo, answering its prompt with the login user's password
+	BecomeSudo BecomeMethod = "sudo"
+	//BecomeSu runs the command with su -, answering its prompt with the target user's password. It always uses a PTY.
+	BecomeSu BecomeMethod = "su"
+)
+
+//suPrompt matches the password prompt su prints on the terminal
+var suPrompt = regexp.MustCompile(`(?i)password[^:\n]*:\s*$`)
+
+//Become describes privilege escalation for a command
+type Become struct {
+	Method   BecomeMethod
+	User     string //the user to become, root when empty
+	Password string //answers the password prompt, may be empty for NOPASSWD sudoers
+}
+
+//BecomeError is returned when the command never ran because privilege escalation failed
+type BecomeError struct {
+	Command string
+	Method  BecomeMethod
+	User    string
+	Reason  string
+	Output  string //what sudo or su printed
+}
+
+func (e *BecomeError) Error() string {
+	msg := fmt.Sprintf("Unable to %v to %v for command '%v': %v", e.Method, e.User, e.Command, e.Reason)
+	if output := strings.TrimSpace(e.Output); output != "" {
+		msg += ": " + output
+	}
+	return Redact(msg)
+}
+
+//escalation runs a command under sudo or su, answering the password prompt and forwarding the command's
+//own stdin once a success marker shows that the command itself has started
+type escalation struct {
+	become  *Become
+	command string
+	prompt  string //sudo is told to print this unique prompt
+	success string //echoed by the shell once privileges are obtained
+
+	mu      sync.Mutex
+	stdin   io.WriteCloser
+	input   io.Reader
+	writers []*escalationWriter
+	prompts int
+	done    bool
+	reason  string
+}
+
+type escalationWriter struct {
+	e   *escalation
+	w   io.Writer
+	buf []byte
+}
+
+//newEscalation returns the escalation for a command and the command line that runs line, the command with any env prefix
+func newEscalation(cmd *Command, line string) (*escalation, string, error) {
+	marker := make([]byte, 8)
+	if _, err := rand.Read(marker); err != nil {
+		return nil, "", err
+	}
+	e := &escalation{
+		become:  cmd.Become,
+		command: cmd.Command,
+		prompt:  "BECOME-PROMPT-" + hex.EncodeToString(marker) + ":",
+		success: "BECOME-SUCCESS-" + hex.EncodeToString(marker),
+		input:   cmd.Stdin,
+	}
+	user := e.user()
+	inner := "echo " + e.success + "; " + line
+	switch cmd.Become.Method {
+	case BecomeSudo:
+		return e, Args("sudo", "-S", "-p", e.prompt, "-u", user, "--", "bash", "-c", inner).String(), nil
+	case BecomeSu:
+		return e, Args("su", "-", user, "-c", inner).String(), nil
+	}
+	return nil, "", fmt.Errorf("Unknown become method: %v", cmd.Become.Method)
+}
+
+func (e *escalation) user() string {
+	return e.become.user()
+}
+
+//user is the user to become, root when none is set
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+//needsPTY reports whether the method only prompts on a terminal
+func (e *escalation) needsPTY() bool {
+	return e.become.Method == BecomeSu
+}
+
+//attach takes over the process stdin and wraps its output streams
+func (e *escalation) attach(stdin io.WriteCloser, stdout io.Writer, stderr io.Writer) (io.Writer, io.Writer) {
+	e.stdin = stdin
+	out := &escalationWriter{e: e, w: stdout}
+	errOut := &escalationWriter{e: e, w: stderr}
+	e.writers = []*escalationWriter{out, errOut}
+	return out, errOut
+}
+
+func (w *escalationWriter) Write(p []byte) (int, error) {
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+	if w.e.done {
+		return w.w.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	w.e.scan(w)
+	return len(p), nil
+}
+
+//scan looks for prompts and the success marker in output buffered before the command started
+func (e *escalation) scan(w *escalationWriter) {
+	if i := bytes.Index(w.buf, []byte(e.prompt)); i >= 0 {
+		w.buf = append(w.buf[:i], w.buf[i+len(e.prompt):]...)
+		e.answer()
+	}
+	if e.become.Method == BecomeSu {
+		if loc := suPrompt.FindIndex(w.buf); loc != nil {
+			w.buf = w.buf[:loc[0]]
+			e.answer()
+		}
+	}
+	i := bytes.Index(w.buf, []byte(e.success))
+	if i < 0 {
+		return
+	}
+	rest := w.buf[i+len(e.success):]
+	rest = bytes.TrimPrefix(bytes.TrimPrefix(rest, []byte("\r")), []byte("\n"))
+	w.buf = append(w.buf[:i:i], rest...)
+	e.done = true
+	//anything else already printed is passed on, apart from the blank lines left by the prompts
+	for _, writer := range e.writers {
+		if len(bytes.TrimSpace(writer.buf)) > 0 {
+			writer.w.Write(bytes.TrimLeft(writer.buf, "\r\n"))
+		}
+		writer.buf = nil
+	}
+	go func() {
+		if e.input != nil {
+			io.Copy(e.stdin, e.input)
+		}
+		e.stdin.Close()
+	}()
+}
+
+//answer sends the password, a second prompt means it was rejected so stdin is closed to make sudo or su give up
+func (e *escalation) answer() {
+	e.prompts++
+	switch {
+	case e.prompts > 1:
+		e.reason = "incorrect password"
+		e.stdin.Close()
+	case e.become.Password == "":
+		e.reason = "a password is required"
+		e.stdin.Close()
+	default:
+		RegisterSecret(e.become.Password)
+		io.WriteString(e.stdin, e.become.Password+"\n")
+	}
+}
+
+//finish turns the result of a command whose escalation never completed into a *BecomeError
+func (e *escalation) finish(err error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done {
+		return err
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return err
+	}
+	var output []string
+	for _, writer := range e.writers {
+		output = append(output, strings.TrimSpace(string(writer.buf)))
+	}
+	reason := e.reason
+	if reason == "" {
+		reason = "command did not start"
+		if err != nil {
+			reason = err.Error()
+		}
+	}
+	return &BecomeError{Command: e.command, Method: e.become.Method, User: e.user(), Reason: reason, Output: strings.TrimSpace(strings.Join(output, "\n"))}
+}
@@ -0,0 +1,84 @@
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//KillGrace is how long a cancelled command gets between SIGTERM and SIGKILL before its session is closed
+var KillGrace = 2 * time.Second
+
+//TimeoutError is returned when a command is stopped because its context was cancelled or its deadline passed
+type TimeoutError struct {
+	Command string
+	Err     error //context.Canceled or context.DeadlineExceeded
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout() {
+		return Redact(fmt.Sprintf("Command '%v' timed out", e.Command))
+	}
+	return Redact(fmt.Sprintf("Command '%v' cancelled: %v", e.Command, e.Err))
+}
+
+//Timeout reports whether the deadline passed rather than the context being cancelled
+func (e *TimeoutError) Timeout() bool {
+	return e.Err == context.DeadlineExceeded
+}
+
+//Unwrap exposes the context error to errors.Is
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+//runContext runs the command on the session, terminating it if the context ends first
+func runContext(ctx context.Context, session *ssh.Session, command string) error {
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	session.Signal(ssh.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(KillGrace):
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+	}
+	return &TimeoutError{Command: command, Err: ctx.Err()}
+}
+
+//clientConn runs the SSH handshake over an established connection, abandoning it if the context ends.
+//Connections tunnelled through a jump host do not support deadlines so the connection is closed instead.
+func clientConn(ctx context.Context, conn net.Conn, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	close(stop)
+	<-stopped
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
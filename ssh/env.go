@@ -0,0 +1,36 @@
+package sshclient
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//envName matches the variable names a POSIX shell can export
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+//splitEnv splits NAME=value at the first "=", values may contain further "=" signs
+func splitEnv(env string) (string, string, error) {
+	parts := strings.SplitN(env, "=", 2)
+	if len(parts) != 2 || !envName.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("Invalid environment variable '%v', expected NAME=value", Redact(env))
+	}
+	return parts[0], parts[1], nil
+}
+
+//ExportPrefix returns a command prefix that exports env, such as "export A='x y' && ", or "" for no env.
+//Values are quoted so they reach the command unchanged, but they do appear on its command line.
+func ExportPrefix(env []string) (string, error) {
+	if len(env) == 0 {
+		return "", nil
+	}
+	var exports []string
+	for _, variable := range env {
+		name, value, err := splitEnv(variable)
+		if err != nil {
+			return "", err
+		}
+		exports = append(exports, name+"="+Quote(value))
+	}
+	return "export " + strings.Join(exports, " ") + " && ", nil
+}
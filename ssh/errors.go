@@ -0,0 +1,44 @@
+package sshclient
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//ExitError is returned when the remote command ran to completion but exited non-zero or was killed by a signal.
+//Any other error returned by a ShellConnection is a transport or setup failure.
+type ExitError struct {
+	Command    string
+	ExitStatus int
+	Signal     string
+	Stderr     string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("Command '%v' exited with status %v", e.Command, e.ExitStatus)
+	if e.Signal != "" {
+		msg = fmt.Sprintf("Command '%v' killed by signal %v", e.Command, e.Signal)
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return Redact(msg)
+}
+
+//exitResult records the exit status of a finished session on the output and converts
+//the ssh package's exit error into an ExitError. Transport errors are passed through.
+func exitResult(out *CommandOutput, err error) error {
+	switch e := err.(type) {
+	case nil:
+		out.ExitStatus = 0
+		return nil
+	case *ssh.ExitError:
+		out.ExitStatus = e.ExitStatus()
+		out.Signal = e.Signal()
+		return &ExitError{Command: out.Command, ExitStatus: out.ExitStatus, Signal: out.Signal, Stderr: out.Stderr}
+	}
+	out.ExitStatus = -1
+	return err
+}
@@ -0,0 +1,216 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//FakeShell is a scriptable in-memory ShellConnection for tests. Commands are matched against
+//the rules in the order they were added and every command is kept in a transcript.
+type FakeShell struct {
+	Prefix string //passed to line handlers, defaults to fake
+	Strict bool   //fail commands that match no rule instead of returning empty success
+
+	mu         sync.Mutex
+	rules      []*FakeRule
+	transcript []*CommandOutput
+}
+
+//FakeRule is a canned response for the commands matching Pattern
+type FakeRule struct {
+	Pattern    *regexp.Regexp
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+	Signal     string
+	Err        error         //returned as a transport failure instead of running
+	Delay      time.Duration //simulates a slow command, cut short by the context
+	Times      int           //how often the rule may match, 0 for no limit
+	Handler    func(cmd *Command, stdin string) (stdout string, stderr string, exitStatus int)
+
+	used int
+}
+
+//NewFakeShell simple constructor
+func NewFakeShell() *FakeShell {
+	return &FakeShell{Prefix: "fake"}
+}
+
+//On adds a rule for commands matching the regular expression, configure it with the FakeRule methods
+func (f *FakeShell) On(pattern string) *FakeRule {
+	rule := &FakeRule{Pattern: regexp.MustCompile(pattern)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, rule)
+	return rule
+}
+
+//Return sets the stdout of the rule
+func (r *FakeRule) Return(stdout string) *FakeRule {
+	r.Stdout = stdout
+	return r
+}
+
+//ReturnStderr sets the stderr of the rule
+func (r *FakeRule) ReturnStderr(stderr string) *FakeRule {
+	r.Stderr = stderr
+	return r
+}
+
+//Exit sets the exit status of the rule
+func (r *FakeRule) Exit(status int) *FakeRule {
+	r.ExitStatus = status
+	return r
+}
+
+//Fail makes the rule return a transport error
+func (r *FakeRule) Fail(err error) *FakeRule {
+	r.Err = err
+	return r
+}
+
+//After delays the rule's response
+func (r *FakeRule) After(delay time.Duration) *FakeRule {
+	r.Delay = delay
+	return r
+}
+
+//Once limits the rule to a single match so a later rule can answer the next call
+func (r *FakeRule) Once() *FakeRule {
+	r.Times = 1
+	return r
+}
+
+//Run computes the response from the command and its stdin
+func (r *FakeRule) Run(handler func(cmd *Command, stdin string) (string, string, int)) *FakeRule {
+	r.Handler = handler
+	return r
+}
+
+//Transcript returns every command run so far with its result, registered secrets are masked
+func (f *FakeShell) Transcript() []*CommandOutput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var transcript []*CommandOutput
+	for _, out := range f.transcript {
+		transcript = append(transcript, out.Redacted())
+	}
+	return transcript
+}
+
+//Commands returns the command strings run so far, registered secrets are masked
+func (f *FakeShell) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var commands []string
+	for _, out := range f.transcript {
+		commands = append(commands, Redact(out.Command))
+	}
+	return commands
+}
+
+//Reset clears the transcript, the rules are kept
+func (f *FakeShell) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transcript = nil
+}
+
+func (f *FakeShell) match(command string) *FakeRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rule := range f.rules {
+		if rule.Times > 0 && rule.used >= rule.Times {
+			continue
+		}
+		if rule.Pattern.MatchString(command) {
+			rule.used++
+			return rule
+		}
+	}
+	return nil
+}
+
+//Command runs a command string against the rules
+func (f *FakeShell) Command(cmdString string) (*CommandOutput, error) {
+	return f.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext runs a command string against the rules
+func (f *FakeShell) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return f.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+//Execute runs a command against the rules
+func (f *FakeShell) Execute(cmd *Command) (*CommandOutput, error) {
+	return f.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs a command against the rules, honouring the context and the command's Timeout
+func (f *FakeShell) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	out := &CommandOutput{Command: cmd.Command, ExitStatus: -1, Start: time.Now()}
+	err := f.execute(ctx, cmd, out)
+	out.End = time.Now()
+	f.mu.Lock()
+	f.transcript = append(f.transcript, out)
+	f.mu.Unlock()
+	return out, err
+}
+
+func (f *FakeShell) execute(ctx context.Context, cmd *Command, out *CommandOutput) error {
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+	if cmd.Stdin != nil {
+		stdin, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		out.Stdin = string(stdin)
+	}
+	rule := f.match(cmd.Command)
+	if rule == nil {
+		if f.Strict {
+			return fmt.Errorf("FakeShell: no rule matches command '%v'", cmd.Command)
+		}
+		rule = &FakeRule{}
+	}
+	if rule.Delay > 0 {
+		select {
+		case <-time.After(rule.Delay):
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		return &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+	}
+	if rule.Err != nil {
+		return rule.Err
+	}
+	stdout, stderr, status := rule.Stdout, rule.Stderr, rule.ExitStatus
+	if rule.Handler != nil {
+		stdout, stderr, status = rule.Handler(cmd, out.Stdin)
+	}
+
+	var stdoutb, stderrb bytes.Buffer
+	outW, errW, flush := cmd.outputWriters(f.Prefix, &stdoutb, &stderrb)
+	io.WriteString(outW, stdout)
+	io.WriteString(errW, stderr)
+	flush()
+	out.Stdout = stdoutb.String()
+	out.Stderr = stderrb.String()
+	out.ExitStatus = status
+	out.Signal = rule.Signal
+	if status != 0 || rule.Signal != "" {
+		return &ExitError{Command: out.Command, ExitStatus: status, Signal: rule.Signal, Stderr: out.Stderr}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FanOut runs the same work across many hosts in parallel
+type FanOut struct {
+	Concurrency int  //how many hosts run at once, 0 for all of them
+	FailFast    bool //cancel outstanding work after the first failure instead of continuing
+}
+
+//FanOutFunc is the work run for one host, the context is cancelled when a fail-fast run aborts
+type FanOutFunc func(ctx context.Context, host string) (*CommandOutput, error)
+
+//HostResult is the outcome for one host of a fan-out run
+type HostResult struct {
+	Host    string
+	Output  *CommandOutput //nil for work that does not run a single command
+	Err     error
+	Skipped bool //the run was cancelled before this host started
+	Start   time.Time
+	End     time.Time
+}
+
+//Report aggregates the per-host results of a fan-out run in the order the hosts were given
+type Report struct {
+	Results []*HostResult
+}
+
+//FanOutError is returned by Report.Err when any host failed or was skipped
+type FanOutError struct {
+	Failed []*HostResult
+	Total  int
+}
+
+func (e *FanOutError) Error() string {
+	var msgs []string
+	for _, result := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", result.Host, result.Err))
+	}
+	return fmt.Sprintf("%v of %v hosts failed: %v", len(e.Failed), e.Total, strings.Join(msgs, "; "))
+}
+
+//Run calls fn for every host with at most Concurrency calls in flight and waits for them all
+func (f FanOut) Run(ctx context.Context, hosts []string, fn FanOutFunc) *Report {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := f.Concurrency
+	if limit <= 0 || limit > len(hosts) {
+		limit = len(hosts)
+	}
+	slots := make(chan struct{}, limit)
+	report := &Report{Results: make([]*HostResult, len(hosts))}
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		result := &HostResult{Host: host}
+		report.Results[i] = result
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			result.Skipped = true
+			result.Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result.Start = time.Now()
+			result.Output, result.Err = fn(ctx, result.Host)
+			result.End = time.Now()
+			if result.Err != nil && f.FailFast {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+//Execute runs a copy of cmd on every connection, the map key names the host in the report.
+//Hosts are run in name order. Stdin cannot be shared between hosts and must be nil.
+func (f FanOut) Execute(ctx context.Context, shells map[string]ShellConnection, cmd *Command) *Report {
+	var hosts []string
+	for host := range shells {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return f.Run(ctx, hosts, func(ctx context.Context, host string) (*CommandOutput, error) {
+		hostCmd := *cmd
+		return shells[host].ExecuteContext(ctx, &hostCmd)
+	})
+}
+
+//Command runs a command string on every connection
+func (f FanOut) Command(ctx context.Context, shells map[string]ShellConnection, cmdString string) *Report {
+	return f.Execute(ctx, shells, &Command{Command: cmdString})
+}
+
+//Failed returns the results of the hosts that failed or were skipped
+func (r *Report) Failed() []*HostResult {
+	var failed []*HostResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+//Succeeded returns the results of the hosts that completed without error
+func (r *Report) Succeeded() []*HostResult {
+	var succeeded []*HostResult
+	for _, result := range r.Results {
+		if result.Err == nil {
+			succeeded = append(succeeded, result)
+		}
+	}
+	return succeeded
+}
+
+//Err returns a *FanOutError describing every failed host, or nil when all hosts succeeded
+func (r *Report) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return &FanOutError{Failed: failed, Total: len(r.Results)}
+}
+
+//String summarises the run one host per line
+func (r *Report) String() string {
+	var lines []string
+	for _, result := range r.Results {
+		switch {
+		case result.Skipped:
+			lines = append(lines, fmt.Sprintf("%v: skipped", result.Host))
+		case result.Err != nil:
+			lines = append(lines, fmt.Sprintf("%v: failed after %v: %v", result.Host, result.End.Sub(result.Start), result.Err))
+		default:
+			lines = append(lines, fmt.Sprintf("%v: ok in %v", result.Host, result.End.Sub(result.Start)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
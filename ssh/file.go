@@ -0,0 +1,164 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//File is a remote file managed idempotently over any ShellConnection, so it is written with whatever privileges
+//the connection's commands run with
+type File struct {
+	Path     string
+	Content  string      //literal content, used when Template is empty
+	Template string      //text/template source rendered with Data
+	Data     interface{} //passed to the template
+	Owner    string      //user or user:group by name, left alone when empty
+	Mode     os.FileMode //permission bits, left alone for existing files and 0644 for new ones when zero
+	Backup   bool        //keep the previous content as Path.bak.<timestamp> before replacing it
+}
+
+//FileResult reports what Apply changed
+type FileResult struct {
+	Path           string
+	Changed        bool //anything at all changed
+	ContentChanged bool
+	AttrsChanged   bool   //owner or mode changed on a file whose content already matched
+	Backup         string //path of the backup taken, if any
+}
+
+//remoteFile is the state of the file on the host
+type remoteFile struct {
+	exists bool
+	sha256 string
+	owner  string //user:group
+	mode   string //octal permission bits as printed by stat
+}
+
+//Render returns the file content, rendering the template if there is one
+func (f *File) Render() ([]byte, error) {
+	if f.Template == "" {
+		return []byte(f.Content), nil
+	}
+	tmpl, err := template.New(f.Path).Option("missingkey=error").Parse(f.Template)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse template for %v: %v", f.Path, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, f.Data); err != nil {
+		return nil, fmt.Errorf("Unable to render template for %v: %v", f.Path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+//Apply makes the remote file match, writing it atomically only when its checksum differs
+//and fixing owner and mode only when they differ
+func (f *File) Apply(ctx context.Context, shell ShellConnection) (*FileResult, error) {
+	content, err := f.Render()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+	current, err := f.stat(ctx, shell)
+	if err != nil {
+		return nil, err
+	}
+	result := &FileResult{Path: f.Path}
+
+	if !current.exists || current.sha256 != want {
+		result.ContentChanged = true
+		result.Changed = true
+		if current.exists && f.Backup {
+			result.Backup = f.Path + ".bak." + time.Now().Format("20060102150405")
+		}
+		_, err := shell.ExecuteContext(ctx, &Command{Command: f.writeCommand(current, result.Backup), Stdin: bytes.NewReader(content)})
+		if err != nil {
+			return result, fmt.Errorf("Unable to write %v: %v", f.Path, err)
+		}
+		return result, nil
+	}
+
+	var fixes []string
+	if f.Mode != 0 && current.mode != f.mode() {
+		fixes = append(fixes, Args("chmod", f.mode(), f.Path).String())
+	}
+	if f.Owner != "" && !ownerMatches(current.owner, f.Owner) {
+		fixes = append(fixes, Args("chown", f.Owner, f.Path).String())
+	}
+	if len(fixes) == 0 {
+		return result, nil
+	}
+	result.AttrsChanged = true
+	result.Changed = true
+	if _, err := shell.ExecuteContext(ctx, &Command{Command: strings.Join(fixes, " && ")}); err != nil {
+		return result, fmt.Errorf("Unable to set owner or mode of %v: %v", f.Path, err)
+	}
+	return result, nil
+}
+
+func (f *File) mode() string {
+	return strconv.FormatUint(uint64(f.Mode.Perm()), 8)
+}
+
+//stat reads the checksum, owner and mode of the remote file
+func (f *File) stat(ctx context.Context, shell ShellConnection) (*remoteFile, error) {
+	path := Quote(f.Path)
+	out, err := shell.ExecuteContext(ctx, &Command{Command: fmt.Sprintf(
+		"if [ -e %v ]; then sha256sum %v && stat -c '%%U:%%G %%a' %v; else echo missing; fi", path, path, path)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check %v: %v", f.Path, err)
+	}
+	fields := strings.Fields(out.Stdout)
+	if len(fields) == 1 && fields[0] == "missing" {
+		return &remoteFile{}, nil
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Unable to check %v: unexpected output %q", f.Path, out.Stdout)
+	}
+	return &remoteFile{exists: true, sha256: fields[0], owner: fields[len(fields)-2], mode: fields[len(fields)-1]}, nil
+}
+
+//writeCommand copies stdin to a temporary file beside the target, carries over or sets its attributes and renames it into place
+func (f *File) writeCommand(current *remoteFile, backup string) string {
+	path := Quote(f.Path)
+	steps := []string{
+		`tmp=$(mktemp ` + Quote(f.Path+".XXXXXX") + `)`,
+		`trap 'rm -f "$tmp"' EXIT`,
+		`cat > "$tmp"`,
+	}
+	if current.exists {
+		steps = append(steps, fmt.Sprintf(`chmod --reference=%v "$tmp"`, path))
+		if f.Owner == "" {
+			steps = append(steps, fmt.Sprintf(`chown --reference=%v "$tmp"`, path))
+		}
+	} else if f.Mode == 0 {
+		steps = append(steps, `chmod 644 "$tmp"`)
+	}
+	if f.Mode != 0 {
+		steps = append(steps, fmt.Sprintf(`chmod %v "$tmp"`, f.mode()))
+	}
+	if f.Owner != "" {
+		steps = append(steps, fmt.Sprintf(`chown %v "$tmp"`, Quote(f.Owner)))
+	}
+	if backup != "" {
+		steps = append(steps, Args("cp", "-p", f.Path, backup).String())
+	}
+	steps = append(steps, fmt.Sprintf(`mv -f "$tmp" %v`, path))
+	return strings.Join(steps, " && ")
+}
+
+//ownerMatches compares user:group from stat with a wanted user or user:group
+func ownerMatches(current string, want string) bool {
+	if strings.Contains(want, ":") {
+		return current == want
+	}
+	return strings.SplitN(current, ":", 2)[0] == want
+}
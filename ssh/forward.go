@@ -0,0 +1,262 @@
+package sshclient
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+//Forwarder is implemented by connections that can forward ports
+type Forwarder interface {
+	ForwardLocal(ctx context.Context, localAddr string, remoteAddr string) (*Forward, error)
+	ForwardRemote(ctx context.Context, remoteAddr string, localAddr string) (*Forward, error)
+	ForwardDynamic(ctx context.Context, localAddr string) (*Forward, error)
+}
+
+//Forward is a running port forward. It stops when its context ends or Close is called.
+type Forward struct {
+	listener net.Listener
+	done     chan struct{}
+	once     sync.Once
+}
+
+//Addr is the listening address, on this machine for local and dynamic forwards and on the server for remote ones
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+//Port is the listening port, useful when the forward was asked to listen on port 0
+func (f *Forward) Port() int {
+	if addr, ok := f.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	_, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+//Done is closed once the forward has stopped accepting connections
+func (f *Forward) Done() <-chan struct{} {
+	return f.done
+}
+
+//Close stops accepting connections, connections already forwarded are left to finish
+func (f *Forward) Close() error {
+	var err error
+	f.once.Do(func() {
+		err = f.listener.Close()
+	})
+	return err
+}
+
+//ForwardLocal listens on localAddr on this machine and forwards each connection to remoteAddr as seen from the server, like ssh -L.
+//Use "127.0.0.1:0" to pick a free port.
+func (s *SSHClient) ForwardLocal(ctx context.Context, localAddr string, remoteAddr string) (*Forward, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %v: %v", localAddr, err)
+	}
+	f := s.serveForward(ctx, listener, func(conn net.Conn) {
+		client, err := s.connection(ctx)
+		if err != nil {
+			logf("Forward to %v via %v failed: %v", remoteAddr, s.host, err)
+			conn.Close()
+			return
+		}
+		remote, err := client.Dial("tcp", remoteAddr)
+		if err != nil {
+			logf("Forward to %v via %v failed: %v", remoteAddr, s.host, err)
+			conn.Close()
+			return
+		}
+		pipe(conn, remote)
+	})
+	return f, nil
+}
+
+//ForwardRemote listens on remoteAddr on the server and forwards each connection to localAddr as seen from this machine, like ssh -R.
+//The server must allow TCP forwarding, and the forward stops if the connection drops.
+func (s *SSHClient) ForwardRemote(ctx context.Context, remoteAddr string, localAddr string) (*Forward, error) {
+	client, err := s.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %v on %v: %v", remoteAddr, s.host, err)
+	}
+	f := s.serveForward(ctx, listener, func(conn net.Conn) {
+		var d net.Dialer
+		local, err := d.DialContext(ctx, "tcp", localAddr)
+		if err != nil {
+			logf("Forward from %v on %v to %v failed: %v", remoteAddr, s.host, localAddr, err)
+			conn.Close()
+			return
+		}
+		pipe(conn, local)
+	})
+	return f, nil
+}
+
+//ForwardDynamic runs a SOCKS5 proxy on localAddr on this machine whose connections are made from the server, like ssh -D.
+//Only the CONNECT command without authentication is supported.
+func (s *SSHClient) ForwardDynamic(ctx context.Context, localAddr string) (*Forward, error) {
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %v: %v", localAddr, err)
+	}
+	f := s.serveForward(ctx, listener, func(conn net.Conn) {
+		target, err := socksHandshake(conn)
+		if err != nil {
+			logf("SOCKS request via %v failed: %v", s.host, err)
+			conn.Close()
+			return
+		}
+		client, err := s.connection(ctx)
+		var remote net.Conn
+		if err == nil {
+			remote, err = client.Dial("tcp", target)
+		}
+		if err != nil {
+			logf("SOCKS connect to %v via %v failed: %v", target, s.host, err)
+			socksReply(conn, socksHostUnreachable)
+			conn.Close()
+			return
+		}
+		if err := socksReply(conn, socksSucceeded); err != nil {
+			conn.Close()
+			remote.Close()
+			return
+		}
+		pipe(conn, remote)
+	})
+	return f, nil
+}
+
+//serveForward accepts connections until the listener closes or the context ends
+func (s *SSHClient) serveForward(ctx context.Context, listener net.Listener, handle func(net.Conn)) *Forward {
+	f := &Forward{listener: listener, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Close()
+		case <-f.done:
+		}
+	}()
+	go func() {
+		defer close(f.done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				f.Close()
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return f
+}
+
+//pipe copies in both directions until either side closes
+func pipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyClose := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		dst.Close()
+	}
+	go copyClose(a, b)
+	go copyClose(b, a)
+	wg.Wait()
+}
+
+const (
+	socksVersion          = 5
+	socksNoAuth           = 0
+	socksNoAcceptable     = 0xff
+	socksConnect          = 1
+	socksIPv4             = 1
+	socksDomain           = 3
+	socksIPv6             = 4
+	socksSucceeded        = 0
+	socksHostUnreachable  = 4
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+)
+
+//socksHandshake negotiates a SOCKS5 CONNECT request and returns the requested host:port
+func socksHandshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("Unsupported SOCKS version %v", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, method := range methods {
+		noAuth = noAuth || method == socksNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", fmt.Errorf("SOCKS client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS command %v", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if request[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS address type %v", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+//socksReply answers a request, the bound address is not reported
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
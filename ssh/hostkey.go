@@ -0,0 +1,205 @@
+package sshclient
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//HostKeyPolicy selects how an SSHClient verifies the server's host key
+type HostKeyPolicy string
+
+const (
+	//HostKeyInsecure accepts any host key, it has to be asked for with WithInsecureHostKey
+	HostKeyInsecure HostKeyPolicy = "insecure"
+	//HostKeyKnownHosts requires the key to be listed in one of the known_hosts files, this is the default
+	HostKeyKnownHosts HostKeyPolicy = "known_hosts"
+	//HostKeyFingerprint requires the key to match one of the pinned SHA256 fingerprints
+	HostKeyFingerprint HostKeyPolicy = "fingerprint"
+	//HostKeyTrustOnFirstUse records unknown hosts in the known_hosts file and verifies them afterwards
+	HostKeyTrustOnFirstUse HostKeyPolicy = "tofu"
+)
+
+//knownHostsMu serialises trust-on-first-use writes from concurrent clients
+var knownHostsMu sync.Mutex
+
+//HostKeyError is returned when the server presents a host key that cannot be verified
+type HostKeyError struct {
+	Host        string
+	Policy      HostKeyPolicy
+	Fingerprint string   //SHA256 fingerprint of the key the server presented
+	Expected    []string //SHA256 fingerprints on record for the host
+	Unknown     bool     //no key on record at all
+	Revoked     bool     //the key is marked @revoked in known_hosts
+}
+
+func (e *HostKeyError) Error() string {
+	switch {
+	case e.Revoked:
+		return fmt.Sprintf("Host key for %v is revoked: %v", e.Host, e.Fingerprint)
+	case e.Unknown:
+		return fmt.Sprintf("Host key for %v is not known (%v): %v", e.Host, e.Policy, e.Fingerprint)
+	default:
+		return fmt.Sprintf("Host key mismatch for %v (%v): got %v, expected one of %v", e.Host, e.Policy, e.Fingerprint, strings.Join(e.Expected, ", "))
+	}
+}
+
+//WithKnownHosts verifies host keys against known_hosts files, ~/.ssh/known_hosts when none are given
+func WithKnownHosts(files ...string) Option {
+	return func(s *SSHClient) {
+		s.hostKeyPolicy = HostKeyKnownHosts
+		s.knownHosts = files
+	}
+}
+
+//WithHostKeyFingerprints pins the host key to one or more SHA256 fingerprints as printed by ssh-keygen -lf
+func WithHostKeyFingerprints(fingerprints ...string) Option {
+	return func(s *SSHClient) {
+		s.hostKeyPolicy = HostKeyFingerprint
+		s.fingerprints = fingerprints
+	}
+}
+
+//WithTrustOnFirstUse records the key of hosts missing from the known_hosts file and rejects changed keys
+func WithTrustOnFirstUse(file string) Option {
+	return func(s *SSHClient) {
+		s.hostKeyPolicy = HostKeyTrustOnFirstUse
+		s.knownHosts = []string{file}
+	}
+}
+
+//WithInsecureHostKey disables host key verification
+func WithInsecureHostKey() Option {
+	return func(s *SSHClient) {
+		s.hostKeyPolicy = HostKeyInsecure
+	}
+}
+
+func (s *SSHClient) knownHostsFiles() ([]string, error) {
+	if len(s.knownHosts) > 0 {
+		return s.knownHosts, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to locate default known_hosts file: %v", err)
+	}
+	return []string{filepath.Join(home, ".ssh", "known_hosts")}, nil
+}
+
+//hostKeyConfig returns the callback for the configured policy and, where keys are on record,
+//the host key algorithms to prefer so the server does not present a different key type.
+func (s *SSHClient) hostKeyConfig(address string) (ssh.HostKeyCallback, []string, error) {
+	switch s.hostKeyPolicy {
+	case HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case HostKeyFingerprint:
+		return s.fingerprintCallback(), nil, nil
+	case "", HostKeyKnownHosts, HostKeyTrustOnFirstUse:
+		files, err := s.knownHostsFiles()
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.hostKeyPolicy == HostKeyTrustOnFirstUse {
+			if err := touch(files[0]); err != nil {
+				return nil, nil, err
+			}
+		}
+		check, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read known_hosts: %v", err)
+		}
+		return s.knownHostsCallback(check, files[0]), knownAlgorithms(check, address), nil
+	}
+	return nil, nil, fmt.Errorf("Unknown host key policy: %v", s.hostKeyPolicy)
+}
+
+func (s *SSHClient) fingerprintCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range s.fingerprints {
+			if !strings.HasPrefix(pinned, "SHA256:") {
+				pinned = "SHA256:" + pinned
+			}
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		return &HostKeyError{Host: hostname, Policy: HostKeyFingerprint, Fingerprint: fingerprint, Expected: s.fingerprints, Unknown: len(s.fingerprints) == 0}
+	}
+}
+
+func (s *SSHClient) knownHostsCallback(check ssh.HostKeyCallback, file string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		switch e := err.(type) {
+		case *knownhosts.RevokedError:
+			return &HostKeyError{Host: hostname, Policy: s.hostKeyPolicy, Fingerprint: fingerprint, Revoked: true}
+		case *knownhosts.KeyError:
+			if len(e.Want) == 0 && s.hostKeyPolicy == HostKeyTrustOnFirstUse {
+				return appendKnownHost(file, hostname, key)
+			}
+			var expected []string
+			for _, want := range e.Want {
+				expected = append(expected, ssh.FingerprintSHA256(want.Key))
+			}
+			return &HostKeyError{Host: hostname, Policy: s.hostKeyPolicy, Fingerprint: fingerprint, Expected: expected, Unknown: len(e.Want) == 0}
+		}
+		return err
+	}
+}
+
+//knownAlgorithms asks the known_hosts database which key types are on record for the address
+func knownAlgorithms(check ssh.HostKeyCallback, address string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	keyErr, ok := check(address, &net.TCPAddr{IP: net.IPv4zero}, probe).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	var algorithms []string
+	for _, want := range keyErr.Want {
+		switch want.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, want.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+func appendKnownHost(file string, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to record host key for %v: %v", hostname, err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+func touch(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
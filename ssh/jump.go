@@ -0,0 +1,85 @@
+package sshclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//DefaultPort is the SSH port used unless WithPort is given
+const DefaultPort = 22
+
+//WithPort connects to a port other than 22
+func WithPort(port int) Option {
+	return func(s *SSHClient) {
+		s.port = port
+	}
+}
+
+//WithProxyJump tunnels the connection through one or more jump hosts, like ssh -J.
+//The first hop is dialled as configured and each later hop through the one before it. The hops
+//passed in are left as they are: a later hop is reached through a copy of it that is kept per
+//previous hop, so its connection is shared by every chain with the same hops before it and the
+//hop itself still connects as it did. Each hop keeps its own credentials and host key policy;
+//Quit the hops separately, which also closes their copies.
+func WithProxyJump(hops ...*SSHClient) Option {
+	return func(s *SSHClient) {
+		if len(hops) == 0 {
+			return
+		}
+		hop := hops[0]
+		for _, next := range hops[1:] {
+			hop = next.through(hop)
+		}
+		s.jump = hop
+	}
+}
+
+//through returns the copy of the client that connects through the jump host via, made once per via
+func (s *SSHClient) through(via *SSHClient) *SSHClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hop, ok := s.routes[via]; ok {
+		return hop
+	}
+	options := append(append([]Option{}, s.options...), func(hop *SSHClient) { hop.jump = via })
+	hop := NewSSHClient(s.user, s.pass, s.host, options...)
+	if s.routes == nil {
+		s.routes = map[*SSHClient]*SSHClient{}
+	}
+	s.routes[via] = hop
+	return hop
+}
+
+//address is the host:port the client connects to, a port given with the hostname is used unless WithPort set one
+func (s *SSHClient) address() string {
+	host, port := s.host, strconv.Itoa(DefaultPort)
+	if h, p, err := net.SplitHostPort(s.host); err == nil {
+		host, port = h, p
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if s.port != 0 {
+		port = strconv.Itoa(s.port)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+//dialTCP opens the transport to address, directly or as a channel through the jump host
+func (s *SSHClient) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	if s.jump == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	via, err := s.jump.connection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach jump host %v: %v", s.jump.host, err)
+	}
+	conn, err := via.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach %v through jump host %v: %v", address, s.jump.host, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,155 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+//LocalShell is a ShellConnection that runs commands on this machine through bash -c.
+//Become works with sudo only, su needs a terminal which LocalShell does not allocate, and PTY is ignored.
+type LocalShell struct {
+	Shell  string //defaults to /bin/bash
+	Prefix string //passed to line handlers, defaults to localhost
+}
+
+//NewLocalShell simple constructor
+func NewLocalShell() *LocalShell {
+	return &LocalShell{Shell: "/bin/bash", Prefix: "localhost"}
+}
+
+//signalNames matches the names the SSH protocol uses for signals
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+}
+
+//Command runs a command string locally
+func (l *LocalShell) Command(cmdString string) (*CommandOutput, error) {
+	return l.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext runs a command string locally, killing it if the context ends first
+func (l *LocalShell) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return l.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+//Execute runs a command locally
+func (l *LocalShell) Execute(cmd *Command) (*CommandOutput, error) {
+	return l.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs a command locally, sending SIGTERM and then SIGKILL to it and its children if the context ends first
+func (l *LocalShell) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	out := &CommandOutput{Command: cmd.Command, ExitStatus: -1, Start: time.Now()}
+	defer func() { out.End = time.Now() }()
+
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		return out, &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+	}
+
+	shell := l.Shell
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = "localhost"
+	}
+	line := cmd.Command
+	var esc *escalation
+	if cmd.Become != nil {
+		if cmd.Become.Method == BecomeSu {
+			return out, &BecomeError{Command: cmd.Command, Method: BecomeSu, User: cmd.Become.user(), Reason: "su needs a PTY, which LocalShell does not allocate"}
+		}
+		//sudo resets the environment so it is exported inside the escalated command
+		exports, err := ExportPrefix(cmd.Env)
+		if err != nil {
+			return out, err
+		}
+		esc, line, err = newEscalation(cmd, exports+line)
+		if err != nil {
+			return out, err
+		}
+	}
+	var stdout, stderr bytes.Buffer
+	proc := exec.Command(shell, "-c", line)
+	proc.Env = append(os.Environ(), cmd.Env...)
+	//the command gets its own process group so a timeout stops the processes it started as well, and a stray
+	//background process left holding stdout or stderr cannot keep Wait from returning
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	proc.WaitDelay = KillGrace
+	var flush func()
+	proc.Stdout, proc.Stderr, flush = cmd.outputWriters(prefix, &stdout, &stderr)
+	if esc != nil {
+		stdin, err := proc.StdinPipe()
+		if err != nil {
+			return out, err
+		}
+		proc.Stdout, proc.Stderr = esc.attach(stdin, proc.Stdout, proc.Stderr)
+	} else {
+		proc.Stdin = cmd.Stdin
+	}
+	if err := proc.Start(); err != nil {
+		return out, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- proc.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+		if err == exec.ErrWaitDelay {
+			//the command itself succeeded, only a background process it left behind still had the output open
+			err = nil
+		}
+	case <-ctx.Done():
+		syscall.Kill(-proc.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(KillGrace):
+			syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
+			<-done
+		}
+		err = &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+	}
+	if esc != nil {
+		err = esc.finish(err)
+	}
+	flush()
+	out.Stdout = stdout.String()
+	out.Stderr = stderr.String()
+
+	switch e := err.(type) {
+	case nil:
+		out.ExitStatus = 0
+	case *exec.ExitError:
+		out.ExitStatus = e.ExitCode()
+		if status, ok := e.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			out.Signal = signalNames[status.Signal()]
+			if out.Signal == "" {
+				out.Signal = status.Signal().String()
+			}
+		}
+		return out, &ExitError{Command: out.Command, ExitStatus: out.ExitStatus, Signal: out.Signal, Stderr: out.Stderr}
+	}
+	return out, err
+}
@@ -0,0 +1,45 @@
+package sshclient
+
+import (
+	"strings"
+)
+
+//Argv is a command and its arguments, each word is quoted when the command line is built
+//so values such as passwords reach the program unchanged whatever characters they contain.
+type Argv []string
+
+//Args builds an Argv from a program name and its arguments
+func Args(name string, args ...string) Argv {
+	return append(Argv{name}, args...)
+}
+
+//String is the quoted command line, ready for bash -c or a ShellConnection
+func (argv Argv) String() string {
+	words := make([]string, len(argv))
+	for i, word := range argv {
+		words[i] = Quote(word)
+	}
+	return strings.Join(words, " ")
+}
+
+//Quote makes s a single word for a POSIX shell. Words made only of safe characters are left as they are,
+//anything else is wrapped in single quotes, which disable $, backticks and backslashes.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, unsafeShellRune) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+func unsafeShellRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return false
+	case strings.ContainsRune("_@%+=:,./-", r):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+package sshclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+//Record is one command of a session recording, secrets registered with RegisterSecret are masked
+type Record struct {
+	Host        string       `json:"host,omitempty"`
+	Command     string       `json:"command"`
+	Env         []string     `json:"env,omitempty"`
+	Become      BecomeMethod `json:"become,omitempty"`
+	StdinSHA256 string       `json:"stdin_sha256,omitempty"`
+	Stdout      string       `json:"stdout"`
+	Stderr      string       `json:"stderr"`
+	ExitStatus  int          `json:"exit_status"`
+	Signal      string       `json:"signal,omitempty"`
+	Error       string       `json:"error,omitempty"` //transport or timeout error, empty for completed commands
+	Start       time.Time    `json:"start"`
+	End         time.Time    `json:"end"`
+}
+
+//Recorder is a ShellConnection that writes every command run through it to a JSONL log
+type Recorder struct {
+	ShellConnection
+	Host string
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+//NewRecorder records the commands run on shell to w, one JSON object per line. Host labels the records.
+func NewRecorder(shell ShellConnection, host string, w io.Writer) *Recorder {
+	return &Recorder{ShellConnection: shell, Host: host, enc: json.NewEncoder(w)}
+}
+
+//Unwrap returns the recorded connection
+func (r *Recorder) Unwrap() ShellConnection {
+	return r.ShellConnection
+}
+
+//Command runs and records a command string
+func (r *Recorder) Command(cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext runs and records a command string
+func (r *Recorder) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+//Execute runs and records a command
+func (r *Recorder) Execute(cmd *Command) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs and records a command, stdin is buffered so its hash can be recorded
+func (r *Recorder) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	recorded := *cmd
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		stdin, err = ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		recorded.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := r.ShellConnection.ExecuteContext(ctx, &recorded)
+	record := newRecord(r.Host, cmd, stdin, out, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if encErr := r.enc.Encode(record); encErr != nil {
+		logf("Unable to record command on %v: %v", r.Host, encErr)
+	}
+	return out, err
+}
+
+func newRecord(host string, cmd *Command, stdin []byte, out *CommandOutput, err error) *Record {
+	record := &Record{Host: host, Command: Redact(cmd.Command), StdinSHA256: stdinHash(stdin)}
+	for _, env := range cmd.Env {
+		record.Env = append(record.Env, Redact(env))
+	}
+	if cmd.Become != nil {
+		record.Become = cmd.Become.Method
+	}
+	if out != nil {
+		redacted := out.Redacted()
+		record.Stdout, record.Stderr = redacted.Stdout, redacted.Stderr
+		record.ExitStatus, record.Signal = out.ExitStatus, out.Signal
+		record.Start, record.End = out.Start, out.End
+	}
+	switch err.(type) {
+	case nil, *ExitError:
+	default:
+		record.Error = Redact(err.Error())
+	}
+	return record
+}
+
+//stdinHash is the SHA256 of stdin with registered secrets masked, empty when there is no stdin
+func stdinHash(stdin []byte) string {
+	if len(stdin) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(Redact(string(stdin))))
+	return hex.EncodeToString(sum[:])
+}
+
+//ReadRecords parses a JSONL session recording
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("Unable to parse recording line %v: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+//Replayer is a ShellConnection that serves a recording back. Each command is answered by the first unused
+//record for the host with the same command, so interleaved recordings replay deterministically.
+type Replayer struct {
+	Prefix string //passed to line handlers, defaults to the host
+
+	mu      sync.Mutex
+	records []*Record
+	used    []bool
+}
+
+//NewReplayer serves the records of one host, an empty host serves every record
+func NewReplayer(records []*Record, host string) *Replayer {
+	r := &Replayer{Prefix: host}
+	for _, record := range records {
+		if host == "" || record.Host == host {
+			r.records = append(r.records, record)
+		}
+	}
+	r.used = make([]bool, len(r.records))
+	if r.Prefix == "" {
+		r.Prefix = "replay"
+	}
+	return r
+}
+
+//Remaining returns the records that have not been replayed yet
+func (r *Replayer) Remaining() []*Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var remaining []*Record
+	for i, record := range r.records {
+		if !r.used[i] {
+			remaining = append(remaining, record)
+		}
+	}
+	return remaining
+}
+
+//Command replays a command string
+func (r *Replayer) Command(cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext replays a command string
+func (r *Replayer) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+//Execute replays a command
+func (r *Replayer) Execute(cmd *Command) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext replays a command, failing when no record matches it or its stdin differs from the recording
+func (r *Replayer) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	out := &CommandOutput{Command: cmd.Command, ExitStatus: -1, Start: time.Now()}
+	defer func() { out.End = time.Now() }()
+	if ctx.Err() != nil {
+		return out, &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+	}
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		stdin, err = ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return out, err
+		}
+		out.Stdin = string(stdin)
+	}
+	record := r.next(Redact(cmd.Command))
+	if record == nil {
+		return out, fmt.Errorf("Replay: no recorded command matches '%v'", Redact(cmd.Command))
+	}
+	if hash := stdinHash(stdin); hash != record.StdinSHA256 {
+		return out, fmt.Errorf("Replay: stdin for '%v' differs from the recording", record.Command)
+	}
+	if record.Error != "" {
+		return out, errors.New(record.Error)
+	}
+
+	var stdout, stderr bytes.Buffer
+	outW, errW, flush := cmd.outputWriters(r.Prefix, &stdout, &stderr)
+	io.WriteString(outW, record.Stdout)
+	io.WriteString(errW, record.Stderr)
+	flush()
+	out.Stdout = stdout.String()
+	out.Stderr = stderr.String()
+	out.ExitStatus = record.ExitStatus
+	out.Signal = record.Signal
+	if record.ExitStatus != 0 || record.Signal != "" {
+		return out, &ExitError{Command: out.Command, ExitStatus: out.ExitStatus, Signal: out.Signal, Stderr: out.Stderr}
+	}
+	return out, nil
+}
+
+func (r *Replayer) next(command string) *Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, record := range r.records {
+		if !r.used[i] && record.Command == command {
+			r.used[i] = true
+			return record
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package sshclient
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Redacted replaces registered secrets in logs, errors and transcripts
+const Redacted = "********"
+
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+//RegisterLogin registers the password of a login, unless it is the same as the username, which stays readable in logs.
+//Every other password is masked whatever its length, including short defaults such as admin.
+func RegisterLogin(user string, password string) {
+	if password == user {
+		return
+	}
+	RegisterSecret(password)
+}
+
+//RegisterSecret adds values that must never appear in log lines, error messages or recorded transcripts
+func RegisterSecret(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		known := false
+		for _, existing := range secrets.values {
+			if existing == value {
+				known = true
+				break
+			}
+		}
+		if !known {
+			secrets.values = append(secrets.values, value)
+		}
+	}
+	//replace longer secrets first so one that contains another is masked whole
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+//Redact masks every registered secret in s
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, value := range secrets.values {
+		s = strings.Replace(s, value, Redacted, -1)
+	}
+	return s
+}
+
+//logf logs a message with registered secrets masked
+func logf(format string, args ...interface{}) {
+	log.Print(Redact(fmt.Sprintf(format, args...)))
+}
+
+//Redacted returns a copy of the output with registered secrets masked, for logging or recording
+func (out *CommandOutput) Redacted() *CommandOutput {
+	redacted := *out
+	redacted.Command = Redact(out.Command)
+	redacted.Stdin = Redact(out.Stdin)
+	redacted.Stdout = Redact(out.Stdout)
+	redacted.Stderr = Redact(out.Stderr)
+	return &redacted
+}
+
+//Secret is a value handed to a remote command on stdin and read into the shell variable Name
+type Secret struct {
+	Name  string
+	Value string
+}
+
+//SecretCommand builds a command that reads each secret line from stdin into its exported variable and then runs line,
+//which refers to them as "$NAME". Only secrets that line refers to are sent. The command line carries no secret values,
+//so it can be logged and passed through sudo safely. Secret values must not contain newlines and are masked in logs.
+func SecretCommand(line string, secrets ...Secret) *Command {
+	var reads []string
+	var stdin strings.Builder
+	for _, secret := range secrets {
+		if !strings.Contains(line, "$"+secret.Name) {
+			continue
+		}
+		RegisterSecret(secret.Value)
+		reads = append(reads, fmt.Sprintf("IFS= read -r %v && export %v", secret.Name, secret.Name))
+		stdin.WriteString(secret.Value + "\n")
+	}
+	cmd := &Command{Command: strings.Join(append(reads, line), " && ")}
+	if len(reads) > 0 {
+		cmd.Stdin = strings.NewReader(stdin.String())
+	}
+	return cmd
+}
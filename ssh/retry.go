@@ -0,0 +1,175 @@
+package sshclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//WithKeepalive sends a keepalive request every interval and drops the connection after maxMissed
+//unanswered requests, so commands on a dead link fail instead of hanging and the next command reconnects
+func WithKeepalive(interval time.Duration, maxMissed int) Option {
+	return func(s *SSHClient) {
+		s.keepaliveInterval = interval
+		s.keepaliveMax = maxMissed
+	}
+}
+
+//watchKeepalive pings the server until the connection closes, dropping it once too many pings go unanswered
+func (s *SSHClient) watchKeepalive(client *ssh.Client, closed <-chan struct{}) {
+	maxMissed := s.keepaliveMax
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+	ticker := time.NewTicker(s.keepaliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err == nil {
+				missed = 0
+				continue
+			}
+			missed = maxMissed
+		case <-time.After(s.keepaliveInterval):
+			missed++
+		case <-closed:
+			return
+		}
+		if missed >= maxMissed {
+			logf("SSH connection to %v is not responding to keepalives, dropping it", s.host)
+			s.drop(client)
+			return
+		}
+	}
+}
+
+//DefaultBackoff is the wait after the first failure when a RetryPolicy sets no Backoff
+const DefaultBackoff = time.Second
+
+//RetryPolicy retries an operation with exponential backoff
+type RetryPolicy struct {
+	Attempts   int           //total attempts including the first, 1 or less disables retries
+	Backoff    time.Duration //wait after the first failure, doubled after each further failure, DefaultBackoff when 0
+	MaxBackoff time.Duration //upper bound on the wait, 0 for none
+	Retryable  func(error) bool
+	OnRetry    func(attempt int, err error, wait time.Duration) //called before each wait, logs by default
+}
+
+//Transient reports whether err looks like a transport failure worth retrying. Failed commands,
+//cancellation, privilege escalation, host key and authentication errors are not transient.
+func Transient(err error) bool {
+	switch err.(type) {
+	case nil, *ExitError, *TimeoutError, *BecomeError, *HostKeyError:
+		return false
+	}
+	return !strings.Contains(err.Error(), "unable to authenticate")
+}
+
+//Do calls fn until it succeeds, returns an error that is not retryable, runs out of attempts or the context ends.
+//The last error is returned.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context, attempt int) error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = Transient
+	}
+	onRetry := p.OnRetry
+	if onRetry == nil {
+		onRetry = func(attempt int, err error, wait time.Duration) {
+			logf("Attempt %v failed, retrying in %v: %v", attempt, wait, err)
+		}
+	}
+	wait := p.Backoff
+	if wait <= 0 {
+		wait = DefaultBackoff
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx, attempt)
+		if err == nil || attempt >= p.Attempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		onRetry(attempt, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
+		if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
+
+//RetryShell is a ShellConnection that retries commands under a RetryPolicy.
+//Output already streamed to a command's writers and line handlers by a failed attempt is not withdrawn.
+type RetryShell struct {
+	ShellConnection
+	Policy RetryPolicy
+}
+
+//NewRetryShell wraps a connection with a retry policy
+func NewRetryShell(shell ShellConnection, policy RetryPolicy) *RetryShell {
+	return &RetryShell{ShellConnection: shell, Policy: policy}
+}
+
+//Unwrap returns the wrapped connection
+func (r *RetryShell) Unwrap() ShellConnection {
+	return r.ShellConnection
+}
+
+//Command runs a command string, retrying under the policy
+func (r *RetryShell) Command(cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext runs a command string, retrying under the policy
+func (r *RetryShell) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return r.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+//Execute runs a command, retrying under the policy
+func (r *RetryShell) Execute(cmd *Command) (*CommandOutput, error) {
+	return r.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs a command, retrying under the policy. Stdin is buffered so every attempt sees all of it.
+func (r *RetryShell) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		stdin, err = ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var out *CommandOutput
+	err := r.Policy.Do(ctx, func(ctx context.Context, attempt int) error {
+		attemptCmd := *cmd
+		if cmd.Stdin != nil {
+			attemptCmd.Stdin = bytes.NewReader(stdin)
+		}
+		var err error
+		out, err = r.ShellConnection.ExecuteContext(ctx, &attemptCmd)
+		return err
+	})
+	return out, err
+}
@@ -1,196 +1,416 @@
 package sshclient
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
-var client *ssh.Client
-var session *ssh.Session
-var user, host, pass string = "", "", ""
+//DefaultMaxSessions matches the OpenSSH server's default MaxSessions
+const DefaultMaxSessions = 10
 
-//ShellConnection represents local, remote or fake unix shell interactions
+//ShellConnection represents local, remote or fake unix shell interactions.
+//A non-nil error is an *ExitError when the command itself failed, anything else is a transport failure.
+//Cancelled or timed out commands return a *TimeoutError.
 type ShellConnection interface {
-	Execute(*Command) (*Command, error)
+	Execute(*Command) (*CommandOutput, error)
 	Command(string) (*CommandOutput, error)
+	ExecuteContext(context.Context, *Command) (*CommandOutput, error)
+	CommandContext(context.Context, string) (*CommandOutput, error)
 }
 
-// SSHClient forms the external type
+//Unwrap returns the innermost connection beneath wrappers such as RetryShell and Recorder,
+//for reaching capabilities like FileTransfer that the wrappers do not pass on
+func Unwrap(shell ShellConnection) ShellConnection {
+	for {
+		wrapper, ok := shell.(interface{ Unwrap() ShellConnection })
+		if !ok {
+			return shell
+		}
+		shell = wrapper.Unwrap()
+	}
+}
+
+// SSHClient forms the external type, it keeps one connection to the host and opens a session per command
 type SSHClient struct {
-	user    string
-	pass    string
-	host    string
-	client  *ssh.Client
-	session *ssh.Session
+	user     string
+	pass     string
+	host     string
+	mu       sync.Mutex
+	client   *ssh.Client
+	sessions chan struct{}
+
+	maxSessions         int
+	prefix              string
+	noSFTP              bool
+	noSetenv            bool
+	port                int
+	keepaliveInterval   time.Duration
+	keepaliveMax        int
+	jump                *SSHClient
+	routes              map[*SSHClient]*SSHClient //copies of this client used as a later hop, by the hop before them
+	options             []Option                  //the options the client was built with, for those copies
+	keys                []privateKey
+	useAgent            bool
+	forwardAgent        bool
+	agent               agent.ExtendedAgent
+	agentConn           net.Conn
+	keyboardInteractive bool
+	challenge           ssh.KeyboardInteractiveChallenge
+	authOrder           []AuthType
+	hostKeyPolicy       HostKeyPolicy
+	knownHosts          []string
+	fingerprints        []string
 }
 
-//Command holds the input and output data for a command
+//Command holds the input and output data for a command, Stdout and Stderr receive a copy of the output if set
+//and OnStdout and OnStderr are called line by line as output streams in.
+//A non-zero Timeout bounds the command in addition to any context deadline.
+//Become runs the command as another user and PTY allocates a terminal, which merges stderr into stdout.
 type Command struct {
-	Command string
-	Env     []string
-	Stdin   io.Reader
-	Stdout  io.Writer
-	Stderr  io.Writer
+	Command  string
+	Env      []string
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+	OnStdout LineHandler
+	OnStderr LineHandler
+	Timeout  time.Duration
+	Become   *Become
+	PTY      bool
 }
 
-//CommandOutput is the buffer contents of a completed command
+//CommandOutput is the buffer contents and result of a completed command.
+//ExitStatus is -1 when the command did not complete.
 type CommandOutput struct {
-	Stdin  string
-	Stdout string
-	Stderr string
+	Command    string
+	Stdin      string
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+	Signal     string
+	Start      time.Time
+	End        time.Time
 }
 
-// NewSSHClient simple constructor
-func NewSSHClient(username string, password string, hostname string) *SSHClient {
+//Duration is the wall clock time the command took
+func (out *CommandOutput) Duration() time.Duration {
+	return out.End.Sub(out.Start)
+}
+
+// NewSSHClient simple constructor, options add key, agent or keyboard-interactive auth
+func NewSSHClient(username string, password string, hostname string, options ...Option) *SSHClient {
 	//simple constructor
 	s := &SSHClient{
 		user: username,
 		pass: password,
 		host: hostname,
 	}
+	s.options = options
+	for _, option := range options {
+		option(s)
+	}
+	if s.maxSessions <= 0 {
+		s.maxSessions = DefaultMaxSessions
+	}
+	if s.prefix == "" {
+		s.prefix = hostname
+	}
+	if s.hostKeyPolicy == "" {
+		s.hostKeyPolicy = HostKeyKnownHosts
+	}
+	s.sessions = make(chan struct{}, s.maxSessions)
+	RegisterLogin(username, password)
+	for _, key := range s.keys {
+		RegisterSecret(key.passphrase)
+	}
 	return s
 
 }
 
+//WithMaxSessions limits how many commands may run concurrently over the connection
+func WithMaxSessions(n int) Option {
+	return func(s *SSHClient) {
+		s.maxSessions = n
+	}
+}
+
 func main() {
 	if len(os.Args) != 5 {
 		log.Fatalf("Usage: %s <user> <password> <host:port> <command>", os.Args[0])
 	}
 
-	user = os.Args[1]
-	pass = os.Args[2]
-	host = os.Args[3]
-
-	s := NewSSHClient(user, pass, host)
+	s := NewSSHClient(os.Args[1], os.Args[2], os.Args[3])
+	defer s.Quit()
 
 	out, err := s.Command(os.Args[4])
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println(string(out.Stdout))
-	client.Close()
 }
 
 //Command takes string and inputs to stdin
 func (s *SSHClient) Command(cmdString string) (*CommandOutput, error) {
-	var stdoutb, stderrb bytes.Buffer
-	stdoutWriter := bufio.NewWriter(&stdoutb)
-	stderrWriter := bufio.NewWriter(&stderrb)
-	cmd := &Command{Command: cmdString, Stderr: stderrWriter, Stdout: stdoutWriter}
-	cmd, err := s.Execute(cmd)
-	//log.Printf("SSH stdout: %v", stdoutb.String())
-	result := &CommandOutput{
-		Stdout: stdoutb.String(),
-		Stderr: stderrb.String()}
-	return result, err
-
-}
-
-// Execute runs an SSH command and returns a struct of stdin, stdout and stderr
-func (s *SSHClient) Execute(cmd *Command) (*Command, error) {
-	//client, session, err := connectToHost(os.Args[1], os.Args[2])
-	_, session, err := s.connectSSHHost(s.user, s.host, s.pass)
+	return s.ExecuteContext(context.Background(), &Command{Command: cmdString})
+}
+
+//CommandContext runs a command string, killing it if the context ends first
+func (s *SSHClient) CommandContext(ctx context.Context, cmdString string) (*CommandOutput, error) {
+	return s.ExecuteContext(ctx, &Command{Command: cmdString})
+}
+
+// Execute runs an SSH command and returns the captured stdout, stderr and exit status
+func (s *SSHClient) Execute(cmd *Command) (*CommandOutput, error) {
+	return s.ExecuteContext(context.Background(), cmd)
+}
+
+//ExecuteContext runs an SSH command, when the context is cancelled or the command's Timeout
+//passes the remote process is signalled, the session closed and a *TimeoutError returned
+func (s *SSHClient) ExecuteContext(ctx context.Context, cmd *Command) (*CommandOutput, error) {
+	out := &CommandOutput{Command: cmd.Command, ExitStatus: -1, Start: time.Now()}
+	defer func() { out.End = time.Now() }()
+
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmd.Timeout)
+		defer cancel()
+	}
+
+	select {
+	case s.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return out, &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+	}
+	defer func() { <-s.sessions }()
+
+	session, err := s.newSession(ctx)
 	if err != nil {
-		panic(err)
+		if ctx.Err() != nil {
+			return out, &TimeoutError{Command: cmd.Command, Err: ctx.Err()}
+		}
+		return out, err
 	}
-	// result, err := session.CombinedOutput(cmd)
-	// if err != nil {
-	// 	// invalidate the sessions?
-	// 	// s.session = nil
-	// 	// s.client = nil
-	// 	panic(err)
-	// }
-	err = s.prepareCommand(session, cmd)
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	line, flush, err := s.prepareCommand(session, cmd, &stdout, &stderr)
 	if err != nil {
-		return cmd, err
+		return out, err
 	}
-	err = session.Run(cmd.Command)
-	return cmd, err
-}
-
-func (s *SSHClient) prepareCommand(session *ssh.Session, cmd *Command) error {
-	for _, env := range cmd.Env {
-		variable := strings.Split(env, "=")
-		if len(variable) != 2 {
-			continue
+	var esc *escalation
+	if cmd.Become != nil {
+		esc, line, err = s.prepareBecome(session, cmd, line)
+		if err != nil {
+			return out, err
 		}
-
-		if err := session.Setenv(variable[0], variable[1]); err != nil {
-			return err
+	}
+	if cmd.PTY || (esc != nil && esc.needsPTY()) {
+		if err := session.RequestPty("xterm", 40, 200, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+			return out, fmt.Errorf("Unable to allocate a PTY on %v: %v", s.host, err)
 		}
 	}
+	err = runContext(ctx, session, line)
+	if esc != nil {
+		err = esc.finish(err)
+	}
+	flush()
+	out.Stdout = stdout.String()
+	out.Stderr = stderr.String()
+	switch err.(type) {
+	case *TimeoutError, *BecomeError:
+		return out, err
+	}
+	return out, exitResult(out, err)
+}
 
-	if cmd.Stdin != nil {
-		stdin, err := session.StdinPipe()
-		if err != nil {
-			return fmt.Errorf("Unable to setup stdin for session: %v", err)
-		}
-		go io.Copy(stdin, cmd.Stdin)
+//prepareBecome wraps the command for sudo or su, the escalation takes over stdin to answer password prompts
+func (s *SSHClient) prepareBecome(session *ssh.Session, cmd *Command, line string) (*escalation, string, error) {
+	esc, line, err := newEscalation(cmd, line)
+	if err != nil {
+		return nil, "", err
+	}
+	session.Stdin = nil
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, "", err
 	}
+	session.Stdout, session.Stderr = esc.attach(stdin, session.Stdout, session.Stderr)
+	return esc, line, nil
+}
 
-	if cmd.Stdout != nil {
-		stdout, err := session.StdoutPipe()
+//prepareCommand wires up env and io and returns the command line to run, the session copies output to completion before Run returns.
+//Env is sent with Setenv where the server accepts it, otherwise it is exported by a prefix on the command line.
+//Commands run with Become always use the prefix because sudo and su reset the environment.
+func (s *SSHClient) prepareCommand(session *ssh.Session, cmd *Command, stdout, stderr *bytes.Buffer) (string, func(), error) {
+	line := cmd.Command
+	if len(cmd.Env) > 0 {
+		prefix, err := ExportPrefix(cmd.Env)
 		if err != nil {
-			return fmt.Errorf("Unable to setup stdout for session: %v", err)
+			return "", nil, err
+		}
+		if cmd.Become != nil || !s.setenv(session, cmd.Env) {
+			line = prefix + line
 		}
-		go io.Copy(cmd.Stdout, stdout)
 	}
 
-	if cmd.Stderr != nil {
-		stderr, err := session.StderrPipe()
-		if err != nil {
-			return fmt.Errorf("Unable to setup stderr for session: %v", err)
+	session.Stdin = cmd.Stdin
+	var flush func()
+	session.Stdout, session.Stderr, flush = cmd.outputWriters(s.prefix, stdout, stderr)
+	return line, flush, nil
+}
+
+//setenv sends env with Setenv, remembering servers that refuse it so later commands go straight to the prefix
+func (s *SSHClient) setenv(session *ssh.Session, env []string) bool {
+	s.mu.Lock()
+	refused := s.noSetenv
+	s.mu.Unlock()
+	if refused {
+		return false
+	}
+	for _, variable := range env {
+		name, value, _ := splitEnv(variable)
+		if err := session.Setenv(name, value); err != nil {
+			logf("%v does not accept env (%v), exporting it on the command line instead", s.host, err)
+			s.mu.Lock()
+			s.noSetenv = true
+			s.mu.Unlock()
+			return false
 		}
-		go io.Copy(cmd.Stderr, stderr)
 	}
-
-	return nil
+	return true
 }
 
 // Quit closes the connection
 func (s *SSHClient) Quit() {
-	s.client.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn = nil
+		s.agent = nil
+	}
+	for _, hop := range s.routes {
+		hop.Quit()
+	}
 }
 
-func (s *SSHClient) getSession() (*ssh.Client, *ssh.Session, error) {
-	if s.session != nil && s.client != nil {
-		return s.client, s.session, nil
+//connection returns the shared client, dialling the host if there is none
+func (s *SSHClient) connection(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
 	}
-	client, session, err := s.connectSSHHost(user, host, pass)
+	client, err := s.connectSSHHost(ctx, s.user)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return client, session, nil
+	s.client = client
+	//forget the connection as soon as the transport goes away so the next command redials
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+		s.drop(client)
+	}()
+	if s.keepaliveInterval > 0 {
+		go s.watchKeepalive(client, closed)
+	}
+	return client, nil
+}
 
+//drop discards a broken connection if it is still the current one
+func (s *SSHClient) drop(client *ssh.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.client.Close()
+		s.client = nil
+	}
 }
 
-func (s *SSHClient) connectSSHHost(user, host, pass string) (*ssh.Client, *ssh.Session, error) {
+//newSession opens a session on the shared connection, reconnecting once if the connection has dropped
+func (s *SSHClient) newSession(ctx context.Context) (*ssh.Session, error) {
+	var session *ssh.Session
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var client *ssh.Client
+		client, err = s.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		session, err = client.NewSession()
+		if err == nil {
+			break
+		}
+		logf("SSH session to %v failed, reconnecting: %v", s.host, err)
+		s.drop(client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+func (s *SSHClient) connectSSHHost(ctx context.Context, user string) (*ssh.Client, error) {
 
+	auth, err := s.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	address := s.address()
+	hostKeyCallback, hostKeyAlgorithms, err := s.hostKeyConfig(address)
+	if err != nil {
+		return nil, err
+	}
+	//the ssh package flattens callback errors into strings, keep the typed one
+	var hostKeyErr *HostKeyError
 	sshConfig := &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User: user,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := hostKeyCallback(hostname, remote, key)
+			if e, ok := err.(*HostKeyError); ok {
+				hostKeyErr = e
+			}
+			return err
+		},
+		HostKeyAlgorithms: hostKeyAlgorithms,
 	}
 
-	newclient, err := ssh.Dial("tcp", host+":22", sshConfig)
+	conn, err := s.dialTCP(ctx, address)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	client, err := clientConn(ctx, conn, address, sshConfig)
+	if hostKeyErr != nil {
+		return nil, hostKeyErr
 	}
-	s.client = newclient
-
-	newsession, err := s.client.NewSession()
 	if err != nil {
+		return nil, err
+	}
+	if err := s.forwardAgentTo(client); err != nil {
 		client.Close()
-		return nil, nil, err
+		return nil, err
 	}
-	s.session = newsession
-
-	return s.client, s.session, nil
+	return client, nil
 }
@@ -0,0 +1,329 @@
+//Package sshtest provides an in-process SSH server for exercising sshclient without a real sshd
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/howels/infra-tools/ssh"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+//Config describes the server's auth, host key and behaviour
+type Config struct {
+	Passwords           map[string]string          //user to password
+	AuthorizedKeys      map[string][]ssh.PublicKey //user to keys accepted for publickey auth
+	KeyboardInteractive bool                       //offer keyboard-interactive auth, answered with the user's password
+	HostKey             ssh.Signer                 //a new ed25519 key is generated when nil
+	Handler             Handler                    //runs exec requests, ShellHandler when nil
+	AcceptEnv           bool                       //accept env requests, like AcceptEnv in sshd_config
+	SFTP                bool                       //serve the sftp subsystem
+	Forwarding          bool                       //allow direct-tcpip channels, the server side of ssh -L and jump hosts
+}
+
+//Session is one exec request passed to a Handler
+type Session struct {
+	User    string
+	Command string
+	Env     []string //accepted env requests as NAME=value
+	PTY     bool     //a PTY was requested, stderr should be merged into stdout
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+}
+
+//Handler runs a command and returns its exit status
+type Handler func(session *Session) int
+
+//Server is a running in-process SSH server listening on a random localhost port
+type Server struct {
+	Addr    string //host:port
+	Host    string
+	Port    int
+	HostKey ssh.Signer
+
+	config   Config
+	listener net.Listener
+	mu       sync.Mutex
+	conns    int
+	commands []string
+}
+
+//ShellHandler runs the command with bash -c using only the session's env.
+//Like sshd it reports the exit status as soon as the command exits, even if the client never closes stdin.
+func ShellHandler(session *Session) int {
+	cmd := exec.Command("bash", "-c", session.Command)
+	cmd.Env = session.Env
+	cmd.Stdout = session.Stdout
+	cmd.Stderr = session.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		go func() {
+			io.Copy(stdin, session.Stdin)
+			stdin.Close()
+		}()
+		err = cmd.Wait()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(session.Stderr, err)
+		return 127
+	}
+	return 0
+}
+
+//Start listens on 127.0.0.1 on a random port and serves connections until Close
+func Start(config Config) (*Server, error) {
+	if config.HostKey == nil {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		config.HostKey, err = ssh.NewSignerFromKey(private)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.Handler == nil {
+		config.Handler = ShellHandler
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		HostKey:  config.HostKey,
+		config:   config,
+		listener: listener,
+	}
+	go s.serve(s.serverConfig())
+	return s, nil
+}
+
+//Close stops accepting connections
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+//Connections is the number of TCP connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+//Commands returns every exec request received so far
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+//Fingerprint is the SHA256 fingerprint of the host key, for sshclient.WithHostKeyFingerprints
+func (s *Server) Fingerprint() string {
+	return ssh.FingerprintSHA256(s.HostKey.PublicKey())
+}
+
+//KnownHostsLine is a known_hosts entry for the server, for sshclient.WithKnownHosts
+func (s *Server) KnownHostsLine() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.HostKey.PublicKey())
+}
+
+//Client returns an SSHClient for the server with its host key pinned, further options add keys or other host key checks
+func (s *Server) Client(user string, password string, options ...sshclient.Option) *sshclient.SSHClient {
+	options = append([]sshclient.Option{sshclient.WithPort(s.Port), sshclient.WithHostKeyFingerprints(s.Fingerprint())}, options...)
+	return sshclient.NewSSHClient(user, password, s.Host, options...)
+}
+
+func (s *Server) serverConfig() *ssh.ServerConfig {
+	config := &ssh.ServerConfig{}
+	if len(s.config.Passwords) > 0 {
+		config.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if want, ok := s.config.Passwords[meta.User()]; ok && want == string(password) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Password rejected for %v", meta.User())
+		}
+	}
+	if len(s.config.AuthorizedKeys) > 0 {
+		config.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range s.config.AuthorizedKeys[meta.User()] {
+				if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("Key rejected for %v", meta.User())
+		}
+	}
+	if s.config.KeyboardInteractive {
+		config.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(meta.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if want, ok := s.config.Passwords[meta.User()]; ok && len(answers) == 1 && answers[0] == want {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Keyboard-interactive rejected for %v", meta.User())
+		}
+	}
+	config.AddHostKey(s.config.HostKey)
+	return config
+}
+
+func (s *Server) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handleConn(conn, config)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go func() {
+		//keepalives are acknowledged, other global requests such as remote forwarding are refused
+		for request := range requests {
+			request.Reply(request.Type == "keepalive@openssh.com", nil)
+		}
+	}()
+	for channel := range channels {
+		switch channel.ChannelType() {
+		case "session":
+			go s.handleSession(serverConn.User(), channel)
+		case "direct-tcpip":
+			if !s.config.Forwarding {
+				channel.Reject(ssh.Prohibited, "forwarding disabled")
+				continue
+			}
+			go handleDirect(channel)
+		default:
+			channel.Reject(ssh.UnknownChannelType, channel.ChannelType())
+		}
+	}
+}
+
+func (s *Server) handleSession(user string, newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	session := &Session{User: user, Stdin: channel, Stdout: channel, Stderr: channel.Stderr()}
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if !s.config.AcceptEnv || ssh.Unmarshal(request.Payload, &env) != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			session.Env = append(session.Env, env.Name+"="+env.Value)
+			request.Reply(true, nil)
+		case "pty-req":
+			session.PTY = true
+			session.Stderr = channel
+			request.Reply(true, nil)
+		case "exec":
+			var exec struct{ Command string }
+			if ssh.Unmarshal(request.Payload, &exec) != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			session.Command = exec.Command
+			s.mu.Lock()
+			s.commands = append(s.commands, exec.Command)
+			s.mu.Unlock()
+			go func() {
+				status := s.config.Handler(session)
+				exitStatus(channel, status)
+			}()
+		case "subsystem":
+			var subsystem struct{ Name string }
+			if !s.config.SFTP || ssh.Unmarshal(request.Payload, &subsystem) != nil || subsystem.Name != "sftp" {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go func() {
+				server, err := sftp.NewServer(channel)
+				if err == nil {
+					server.Serve()
+				}
+				exitStatus(channel, 0)
+			}()
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+func exitStatus(channel ssh.Channel, status int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(status))
+	channel.SendRequest("exit-status", false, payload)
+	channel.Close()
+}
+
+func handleDirect(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	io.Copy(conn, channel)
+	conn.Close()
+}
@@ -0,0 +1,86 @@
+package sshclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+//LineHandler receives each line of remote output as it arrives, without the trailing newline.
+//The prefix identifies the host the line came from.
+type LineHandler func(prefix string, line string)
+
+//PrintLines returns a LineHandler that writes "[prefix] line" to w, safe for use by concurrent commands
+func PrintLines(w io.Writer) LineHandler {
+	var mu sync.Mutex
+	return func(prefix string, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "[%v] %v\n", prefix, line)
+	}
+}
+
+//WithPrefix sets the prefix passed to line handlers, the hostname is used by default
+func WithPrefix(prefix string) Option {
+	return func(s *SSHClient) {
+		s.prefix = prefix
+	}
+}
+
+//lineWriter splits a byte stream into lines for a LineHandler
+type lineWriter struct {
+	prefix  string
+	handler LineHandler
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.handler(w.prefix, strings.TrimSuffix(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+//Flush hands any final unterminated line to the handler
+func (w *lineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.handler(w.prefix, strings.TrimSuffix(string(w.partial), "\r"))
+		w.partial = nil
+	}
+}
+
+//outputWriters combines the capture buffers with the command's own writers and line handlers.
+//The returned flush must be called once the command has finished writing.
+func (cmd *Command) outputWriters(prefix string, stdout, stderr *bytes.Buffer) (io.Writer, io.Writer, func()) {
+	var flushers []*lineWriter
+	combine := func(buffer *bytes.Buffer, w io.Writer, handler LineHandler) io.Writer {
+		writers := []io.Writer{buffer}
+		if w != nil {
+			writers = append(writers, w)
+		}
+		if handler != nil {
+			lw := &lineWriter{prefix: prefix, handler: handler}
+			flushers = append(flushers, lw)
+			writers = append(writers, lw)
+		}
+		if len(writers) == 1 {
+			return buffer
+		}
+		return io.MultiWriter(writers...)
+	}
+	outW := combine(stdout, cmd.Stdout, cmd.OnStdout)
+	errW := combine(stderr, cmd.Stderr, cmd.OnStderr)
+	return outW, errW, func() {
+		for _, lw := range flushers {
+			lw.Flush()
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package sshclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+//ProgressFunc reports how many bytes of the file at path have been transferred out of total
+type ProgressFunc func(path string, transferred int64, total int64)
+
+//TransferOptions controls uploads and downloads
+type TransferOptions struct {
+	Mode     os.FileMode //permissions for the written file, the source file's permissions if zero
+	Verify   bool        //compare SHA256 checksums of both ends after each file
+	Progress ProgressFunc
+	SCP      bool //skip SFTP, for hosts such as ESXi that have no SFTP subsystem
+}
+
+//FileTransfer is implemented by connections that can copy files to and from the remote host
+type FileTransfer interface {
+	Upload(ctx context.Context, local string, remote string, opts *TransferOptions) error
+	Download(ctx context.Context, remote string, local string, opts *TransferOptions) error
+	UploadDir(ctx context.Context, local string, remote string, opts *TransferOptions) error
+	DownloadDir(ctx context.Context, remote string, local string, opts *TransferOptions) error
+}
+
+//ChecksumError is returned when the file on both ends differs after a transfer
+type ChecksumError struct {
+	Path   string
+	Local  string
+	Remote string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch for %v: local %v, remote %v", e.Path, e.Local, e.Remote)
+}
+
+//LogProgress returns a ProgressFunc that logs each file as it passes every 25%
+func LogProgress() ProgressFunc {
+	var mu sync.Mutex
+	logged := map[string]int64{}
+	return func(path string, transferred int64, total int64) {
+		step := int64(4)
+		if total > 0 {
+			step = transferred * 4 / total
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if last, ok := logged[path]; ok && last >= step {
+			return
+		}
+		logged[path] = step
+		logf("Transfer %v: %v%% of %v bytes", path, step*25, total)
+	}
+}
+
+//Upload copies a local file to the remote path, creating parent directories as needed
+func (s *SSHClient) Upload(ctx context.Context, local string, remote string, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	return s.transfer(ctx, opts, func(client *sftp.Client) error {
+		if client != nil {
+			if err := client.MkdirAll(path.Dir(remote)); err != nil {
+				return err
+			}
+			return sftpUpload(ctx, client, local, remote, opts)
+		}
+		if _, err := s.CommandContext(ctx, "mkdir -p "+Quote(path.Dir(remote))); err != nil {
+			return err
+		}
+		return s.scpUpload(ctx, local, remote, opts)
+	}, func() error {
+		return s.verify(ctx, local, remote)
+	})
+}
+
+//Download copies a remote file to the local path, creating parent directories as needed
+func (s *SSHClient) Download(ctx context.Context, remote string, local string, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	return s.transfer(ctx, opts, func(client *sftp.Client) error {
+		if client != nil {
+			return sftpDownload(ctx, client, remote, local, opts)
+		}
+		return s.scpDownload(ctx, remote, local, opts)
+	}, func() error {
+		return s.verify(ctx, local, remote)
+	})
+}
+
+//UploadDir copies a local directory tree to the remote path
+func (s *SSHClient) UploadDir(ctx context.Context, local string, remote string, opts *TransferOptions) error {
+	return filepath.Walk(local, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(local, file)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remote, filepath.ToSlash(rel))
+		if info.IsDir() {
+			_, err := s.CommandContext(ctx, "mkdir -p "+Quote(target))
+			return err
+		}
+		return s.Upload(ctx, file, target, opts)
+	})
+}
+
+//DownloadDir copies a remote directory tree to the local path
+func (s *SSHClient) DownloadDir(ctx context.Context, remote string, local string, opts *TransferOptions) error {
+	out, err := s.CommandContext(ctx, "cd "+Quote(remote)+" && find . -type f")
+	if err != nil {
+		return err
+	}
+	for _, rel := range strings.Split(strings.TrimSpace(out.Stdout), "\n") {
+		if rel == "" {
+			continue
+		}
+		rel = strings.TrimPrefix(rel, "./")
+		err := s.Download(ctx, path.Join(remote, rel), filepath.Join(local, filepath.FromSlash(rel)), opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//transfer runs copyFile over SFTP, or with a nil client over SCP when SFTP is unavailable, and then the verification
+func (s *SSHClient) transfer(ctx context.Context, opts *TransferOptions, copyFile func(*sftp.Client) error, verify func() error) error {
+	s.mu.Lock()
+	useSCP := opts.SCP || s.noSFTP
+	s.mu.Unlock()
+	if !useSCP {
+		err := s.withSession(ctx, func(conn *ssh.Client) error {
+			client, session, err := sftpClient(conn)
+			if refused, ok := err.(*sftpRefusedError); ok {
+				logf("SFTP unavailable on %v, falling back to SCP: %v", s.host, refused.Err)
+				s.mu.Lock()
+				s.noSFTP = true
+				s.mu.Unlock()
+				useSCP = true
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to start SFTP on %v: %v", s.host, err)
+			}
+			defer session.Close()
+			defer client.Close()
+			return copyFile(client)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if useSCP {
+		if err := copyFile(nil); err != nil {
+			return err
+		}
+	}
+	if opts.Verify {
+		return verify()
+	}
+	return nil
+}
+
+//sftpRefusedError is returned by sftpClient when the server has no SFTP subsystem
+type sftpRefusedError struct {
+	Err error
+}
+
+func (e *sftpRefusedError) Error() string {
+	return "SFTP subsystem refused: " + e.Err.Error()
+}
+
+//sftpClient starts the SFTP subsystem like sftp.NewClient, telling a server that refuses it or closes the channel
+//straight away apart from failures such as running out of sessions, which may go away on the next try
+func sftpClient(conn *ssh.Client) (*sftp.Client, *ssh.Session, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, nil, &sftpRefusedError{Err: err}
+	}
+	pw, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	pr, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	client, err := sftp.NewClientPipe(pr, pw)
+	if err != nil {
+		session.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, &sftpRefusedError{Err: err}
+		}
+		return nil, nil, err
+	}
+	return client, session, nil
+}
+
+//withSession runs fn holding one of the client's session slots
+func (s *SSHClient) withSession(ctx context.Context, fn func(*ssh.Client) error) error {
+	select {
+	case s.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.sessions }()
+	conn, err := s.connection(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (s *SSHClient) verify(ctx context.Context, local string, remote string) error {
+	localSum, err := fileChecksum(local)
+	if err != nil {
+		return err
+	}
+	out, err := s.CommandContext(ctx, "sha256sum "+Quote(remote))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(out.Stdout)
+	if len(fields) == 0 || fields[0] != localSum {
+		remoteSum := ""
+		if len(fields) > 0 {
+			remoteSum = fields[0]
+		}
+		return &ChecksumError{Path: remote, Local: localSum, Remote: remoteSum}
+	}
+	return nil
+}
+
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//progressWriter counts bytes through to the ProgressFunc and stops the copy when the context ends
+type progressWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	path     string
+	done     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if p.progress != nil {
+		p.progress(p.path, p.done, p.total)
+	}
+	return n, err
+}
+
+func fileMode(opts *TransferOptions, source os.FileMode) os.FileMode {
+	if opts.Mode != 0 {
+		return opts.Mode
+	}
+	return source.Perm()
+}
+
+func sftpUpload(ctx context.Context, client *sftp.Client, local string, remote string, opts *TransferOptions) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("Unable to create %v: %v", remote, err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(&progressWriter{ctx: ctx, w: dst, path: remote, total: info.Size(), progress: opts.Progress}, src)
+	if err != nil {
+		return err
+	}
+	return dst.Chmod(fileMode(opts, info.Mode()))
+}
+
+func sftpDownload(ctx context.Context, client *sftp.Client, remote string, local string, opts *TransferOptions) error {
+	src, err := client.Open(remote)
+	if err != nil {
+		return fmt.Errorf("Unable to open %v: %v", remote, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode(opts, info.Mode()))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(&progressWriter{ctx: ctx, w: dst, path: remote, total: info.Size(), progress: opts.Progress}, src)
+	if err != nil {
+		return err
+	}
+	return dst.Chmod(fileMode(opts, info.Mode()))
+}
+
+//scpAck reads the single byte status the remote scp sends after every message
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("scp: %v", strings.TrimSpace(msg))
+}
+
+//scpSession starts a remote scp in sink or source mode and hands its pipes to fn
+func (s *SSHClient) scpSession(ctx context.Context, command string, fn func(io.WriteCloser, *bufio.Reader) error) error {
+	return s.withSession(ctx, func(conn *ssh.Client) error {
+		session, err := conn.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := session.Start(command); err != nil {
+			return err
+		}
+		if err := fn(stdin, bufio.NewReader(stdout)); err != nil {
+			return err
+		}
+		stdin.Close()
+		return session.Wait()
+	})
+}
+
+func (s *SSHClient) scpUpload(ctx context.Context, local string, remote string, opts *TransferOptions) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	return s.scpSession(ctx, "scp -qt "+Quote(remote), func(w io.WriteCloser, r *bufio.Reader) error {
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "C%04o %d %s\n", fileMode(opts, info.Mode()), info.Size(), path.Base(remote))
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		_, err := io.Copy(&progressWriter{ctx: ctx, w: w, path: remote, total: info.Size(), progress: opts.Progress}, src)
+		if err != nil {
+			return err
+		}
+		w.Write([]byte{0})
+		return scpAck(r)
+	})
+}
+
+func (s *SSHClient) scpDownload(ctx context.Context, remote string, local string, opts *TransferOptions) error {
+	return s.scpSession(ctx, "scp -qf "+Quote(remote), func(w io.WriteCloser, r *bufio.Reader) error {
+		w.Write([]byte{0})
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(header, "C") {
+			return fmt.Errorf("scp: %v", strings.TrimSpace(header[1:]))
+		}
+		fields := strings.SplitN(strings.TrimSpace(header[1:]), " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("scp: unexpected header %q", header)
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		dst, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode(opts, os.FileMode(mode)))
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		w.Write([]byte{0})
+		_, err = io.CopyN(&progressWriter{ctx: ctx, w: dst, path: remote, total: size, progress: opts.Progress}, r, size)
+		if err != nil {
+			return err
+		}
+		if err := scpAck(r); err != nil {
+			return err
+		}
+		w.Write([]byte{0})
+		return dst.Chmod(fileMode(opts, os.FileMode(mode)))
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/howels/infra-tools/ssh"
+	"github.com/howels/infra-tools/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+//check is one case of the suite, a non-nil error fails it
+type check struct {
+	name string
+	run  func(server *sshtest.Server) error
+}
+
+func main() {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		log.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	server, err := sshtest.Start(sshtest.Config{
+		Passwords:           map[string]string{"sshtest": "sshtest"},
+		AuthorizedKeys:      map[string][]ssh.PublicKey{"keyuser": {signer.PublicKey()}},
+		KeyboardInteractive: true,
+		AcceptEnv:           true,
+		SFTP:                true,
+		Forwarding:          true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+
+	checks := []check{
+		{"password auth", func(server *sshtest.Server) error {
+			return expectStdout(server.Client("sshtest", "sshtest"), "echo hello", "hello\n")
+		}},
+		{"wrong password is rejected", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "wrong")
+			defer s.Quit()
+			if _, err := s.Command("true"); err == nil {
+				return fmt.Errorf("command ran with a wrong password")
+			}
+			return nil
+		}},
+		{"public key auth", func(server *sshtest.Server) error {
+			return expectStdout(server.Client("keyuser", "", sshclient.WithPrivateKey(keyPEM, "")), "echo key", "key\n")
+		}},
+		{"keyboard-interactive auth", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest", sshclient.WithKeyboardInteractive(nil), sshclient.WithAuthOrder(sshclient.AuthKeyboardInteractive))
+			return expectStdout(s, "echo ki", "ki\n")
+		}},
+		{"pinned host key", func(server *sshtest.Server) error {
+			return expectStdout(server.Client("sshtest", "sshtest", sshclient.WithHostKeyFingerprints(server.Fingerprint())), "echo pinned", "pinned\n")
+		}},
+		{"port given with the hostname", func(server *sshtest.Server) error {
+			s := sshclient.NewSSHClient("sshtest", "sshtest", server.Addr, sshclient.WithHostKeyFingerprints(server.Fingerprint()))
+			return expectStdout(s, "echo hostport", "hostport\n")
+		}},
+		{"wrong host key is rejected", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest", sshclient.WithHostKeyFingerprints("SHA256:AAAA"))
+			defer s.Quit()
+			_, err := s.Command("true")
+			if _, ok := err.(*sshclient.HostKeyError); !ok {
+				return fmt.Errorf("expected *sshclient.HostKeyError, got %v", err)
+			}
+			return nil
+		}},
+		{"exit status", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			out, err := s.Command("echo oops >&2; exit 3")
+			exitErr, ok := err.(*sshclient.ExitError)
+			if !ok || exitErr.ExitStatus != 3 || out.ExitStatus != 3 || out.Stderr != "oops\n" {
+				return fmt.Errorf("expected exit status 3 with stderr, got %v %+v", err, out)
+			}
+			return nil
+		}},
+		{"env", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			out, err := s.Execute(&sshclient.Command{Command: "echo $GREETING", Env: []string{"GREETING=a=b"}})
+			if err != nil || out.Stdout != "a=b\n" {
+				return fmt.Errorf("expected env to reach the command, got %v %q", err, out.Stdout)
+			}
+			return nil
+		}},
+		{"env refused by the server is exported instead", func(server *sshtest.Server) error {
+			strict, err := sshtest.Start(sshtest.Config{Passwords: map[string]string{"sshtest": "sshtest"}})
+			if err != nil {
+				return err
+			}
+			defer strict.Close()
+			s := strict.Client("sshtest", "sshtest")
+			defer s.Quit()
+			value := "it's $HOME `id` a=b"
+			out, err := s.Execute(&sshclient.Command{Command: "printf %s \"$GREETING\"", Env: []string{"GREETING=" + value}})
+			if err != nil || out.Stdout != value {
+				return fmt.Errorf("expected env to reach the command, got %v %q", err, out.Stdout)
+			}
+			return nil
+		}},
+		{"stdin", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			out, err := s.Execute(&sshclient.Command{Command: "tr a-z A-Z", Stdin: strings.NewReader("shout")})
+			if err != nil || out.Stdout != "SHOUT" {
+				return fmt.Errorf("expected stdin to reach the command, got %v %q", err, out.Stdout)
+			}
+			return nil
+		}},
+		{"streaming", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest", sshclient.WithPrefix("node1"))
+			defer s.Quit()
+			var mu sync.Mutex
+			var lines []string
+			_, err := s.Execute(&sshclient.Command{Command: "for i in 1 2 3; do echo line$i; done; printf partial", OnStdout: func(prefix string, line string) {
+				mu.Lock()
+				defer mu.Unlock()
+				lines = append(lines, prefix+":"+line)
+			}})
+			got := strings.Join(lines, ",")
+			if err != nil || got != "node1:line1,node1:line2,node1:line3,node1:partial" {
+				return fmt.Errorf("unexpected streamed lines %v %q", err, got)
+			}
+			return nil
+		}},
+		{"one connection for many commands", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			before := server.Connections()
+			for i := 0; i < 5; i++ {
+				if _, err := s.Command("true"); err != nil {
+					return err
+				}
+			}
+			if opened := server.Connections() - before; opened != 1 {
+				return fmt.Errorf("expected 1 connection, %v were opened", opened)
+			}
+			return nil
+		}},
+		{"timeout stops the command", func(server *sshtest.Server) error {
+			grace := sshclient.KillGrace
+			sshclient.KillGrace = 100 * time.Millisecond
+			defer func() { sshclient.KillGrace = grace }()
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			start := time.Now()
+			_, err := s.Execute(&sshclient.Command{Command: "sleep 3", Timeout: 200 * time.Millisecond})
+			timeoutErr, ok := err.(*sshclient.TimeoutError)
+			if !ok || !timeoutErr.Timeout() {
+				return fmt.Errorf("expected *sshclient.TimeoutError for the deadline, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				return fmt.Errorf("command was stopped only after %v", elapsed)
+			}
+			return nil
+		}},
+		{"cancelled context stops the command", func(server *sshtest.Server) error {
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := s.ExecuteContext(ctx, &sshclient.Command{Command: "true"})
+			timeoutErr, ok := err.(*sshclient.TimeoutError)
+			if !ok || timeoutErr.Timeout() {
+				return fmt.Errorf("expected *sshclient.TimeoutError for the cancellation, got %v", err)
+			}
+			return nil
+		}},
+		{"sftp upload and download", func(server *sshtest.Server) error {
+			return roundTrip(server, &sshclient.TransferOptions{Verify: true})
+		}},
+		{"scp upload and download", func(server *sshtest.Server) error {
+			return roundTrip(server, &sshclient.TransferOptions{Verify: true, SCP: true})
+		}},
+		{"server without sftp falls back to scp", func(server *sshtest.Server) error {
+			plain, err := sshtest.Start(sshtest.Config{Passwords: map[string]string{"sshtest": "sshtest"}})
+			if err != nil {
+				return err
+			}
+			defer plain.Close()
+			return roundTrip(plain, &sshclient.TransferOptions{Verify: true})
+		}},
+		{"upload directory", func(server *sshtest.Server) error {
+			dir, err := ioutil.TempDir("", "sshtest")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			local := filepath.Join(dir, "local")
+			if err := os.MkdirAll(filepath.Join(local, "sub"), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(local, "sub", "file.txt"), []byte("nested"), 0644); err != nil {
+				return err
+			}
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			if err := s.UploadDir(context.Background(), local, filepath.Join(dir, "remote"), &sshclient.TransferOptions{Verify: true}); err != nil {
+				return err
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dir, "remote", "sub", "file.txt"))
+			if err != nil || string(got) != "nested" {
+				return fmt.Errorf("expected the nested file to be uploaded, got %v %q", err, got)
+			}
+			return nil
+		}},
+		{"proxy jump", func(server *sshtest.Server) error {
+			jump := server.Client("sshtest", "sshtest")
+			defer jump.Quit()
+			before := server.Connections()
+			s := sshclient.NewSSHClient("sshtest", "sshtest", server.Addr, sshclient.WithHostKeyFingerprints(server.Fingerprint()), sshclient.WithProxyJump(jump))
+			if err := expectStdout(s, "echo jumped", "jumped\n"); err != nil {
+				return err
+			}
+			if opened := server.Connections() - before; opened != 2 {
+				return fmt.Errorf("expected a connection to the jump host and one through it, %v were opened", opened)
+			}
+			return nil
+		}},
+		{"jump hosts of a chain are left unchanged", func(server *sshtest.Server) error {
+			first, second := server.Client("sshtest", "sshtest"), server.Client("sshtest", "sshtest")
+			defer first.Quit()
+			defer second.Quit()
+			s := sshclient.NewSSHClient("sshtest", "sshtest", server.Addr, sshclient.WithHostKeyFingerprints(server.Fingerprint()), sshclient.WithProxyJump(first, second))
+			if err := expectStdout(s, "echo twice", "twice\n"); err != nil {
+				return err
+			}
+			first.Quit()
+			before := server.Connections()
+			if err := expectStdout(second, "echo direct", "direct\n"); err != nil {
+				return err
+			}
+			if opened := server.Connections() - before; opened != 1 {
+				return fmt.Errorf("expected the second hop to connect directly on its own, %v connections were opened", opened)
+			}
+			return nil
+		}},
+		{"local forward", func(server *sshtest.Server) error {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					io.Copy(conn, conn)
+					conn.Close()
+				}
+			}()
+			s := server.Client("sshtest", "sshtest")
+			defer s.Quit()
+			forward, err := s.ForwardLocal(context.Background(), "127.0.0.1:0", listener.Addr().String())
+			if err != nil {
+				return err
+			}
+			defer forward.Close()
+			conn, err := net.Dial("tcp", forward.Addr().String())
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			fmt.Fprintln(conn, "ping")
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "ping\n" {
+				return fmt.Errorf("expected the echo through the forward, got %v %q", err, line)
+			}
+			return nil
+		}},
+		{"sudo password prompt is answered", func(server *sshtest.Server) error {
+			return withSudo(func(sudo *sshtest.Server) error {
+				s := sudo.Client("sshtest", "sshtest")
+				defer s.Quit()
+				out, err := s.Execute(&sshclient.Command{Command: "cat", Stdin: strings.NewReader("after sudo"), Become: &sshclient.Become{Method: sshclient.BecomeSudo, Password: "sshtest"}})
+				if err != nil || out.Stdout != "after sudo" {
+					return fmt.Errorf("expected stdin to reach the command once sudo accepted the password, got %v %q", err, out.Stdout)
+				}
+				return nil
+			})
+		}},
+		{"wrong sudo password is a BecomeError", func(server *sshtest.Server) error {
+			return withSudo(func(sudo *sshtest.Server) error {
+				s := sudo.Client("sshtest", "sshtest")
+				defer s.Quit()
+				_, err := s.Execute(&sshclient.Command{Command: "true", Become: &sshclient.Become{Method: sshclient.BecomeSudo, Password: "wrong"}})
+				becomeErr, ok := err.(*sshclient.BecomeError)
+				if !ok || becomeErr.Reason != "incorrect password" {
+					return fmt.Errorf("expected *sshclient.BecomeError for an incorrect password, got %v", err)
+				}
+				return nil
+			})
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(server); err != nil {
+			failed++
+			log.Printf("FAIL %v: %v", c.name, err)
+			continue
+		}
+		log.Printf("ok   %v", c.name)
+	}
+	if failed > 0 {
+		log.Printf("%v of %v checks failed", failed, len(checks))
+		os.Exit(1)
+	}
+	log.Printf("All %v checks passed", len(checks))
+}
+
+func expectStdout(s *sshclient.SSHClient, command string, want string) error {
+	defer s.Quit()
+	out, err := s.Command(command)
+	if err != nil {
+		return err
+	}
+	if out.Stdout != want {
+		return fmt.Errorf("expected %q, got %q", want, out.Stdout)
+	}
+	return nil
+}
+
+//roundTrip uploads a file and downloads it again with the transfer options
+func roundTrip(server *sshtest.Server, opts *sshclient.TransferOptions) error {
+	dir, err := ioutil.TempDir("", "sshtest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local, remote, back := filepath.Join(dir, "local.txt"), filepath.Join(dir, "remote.txt"), filepath.Join(dir, "back.txt")
+	if err := ioutil.WriteFile(local, []byte("transfer me\n"), 0640); err != nil {
+		return err
+	}
+	s := server.Client("sshtest", "sshtest")
+	defer s.Quit()
+	if err := s.Upload(context.Background(), local, remote, opts); err != nil {
+		return err
+	}
+	if err := s.Download(context.Background(), remote, back, opts); err != nil {
+		return err
+	}
+	got, err := ioutil.ReadFile(back)
+	if err != nil || string(got) != "transfer me\n" {
+		return fmt.Errorf("expected the file back unchanged, got %v %q", err, got)
+	}
+	return nil
+}
+
+//sudoLine is the command line an escalation with sudo sends
+var sudoLine = regexp.MustCompile(`(?s)^sudo -S -p (\S+) -u \S+ -- (.*)$`)
+
+//withSudo runs the check against a server whose sudo prompts on stderr for the sshtest password, like sudo -S
+func withSudo(run func(sudo *sshtest.Server) error) error {
+	sudo, err := sshtest.Start(sshtest.Config{Passwords: map[string]string{"sshtest": "sshtest"}, Handler: func(session *sshtest.Session) int {
+		m := sudoLine.FindStringSubmatch(session.Command)
+		if m == nil {
+			return sshtest.ShellHandler(session)
+		}
+		for attempt := 0; attempt < 2; attempt++ {
+			fmt.Fprint(session.Stderr, m[1])
+			if readLine(session.Stdin) == "sshtest" {
+				command := *session
+				command.Command = m[2]
+				return sshtest.ShellHandler(&command)
+			}
+			fmt.Fprintln(session.Stderr, "Sorry, try again.")
+		}
+		fmt.Fprintln(session.Stderr, "sudo: 2 incorrect password attempts")
+		return 1
+	}})
+	if err != nil {
+		return err
+	}
+	defer sudo.Close()
+	return run(sudo)
+}
+
+//readLine reads one line a byte at a time, leaving the rest of stdin to the command
+func readLine(r io.Reader) string {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := r.Read(b); err != nil || b[0] == '\n' {
+			return string(line)
+		}
+		line = append(line, b[0])
+	}
+}
@@ -17,6 +17,7 @@ import (
 //Vcenter is the main struct
 type Vcenter struct {
 	Credentials *Credentials //move this to a common package
+	Address     string       //host:port to connect to instead of Credentials.IP, such as an SSH forwarded port
 	Insecure    bool
 	Client      *govmomi.Client
 	Context     context.Context
@@ -30,6 +31,9 @@ type Credentials struct {
 }
 
 func (vc *Vcenter) envURL() string {
+	if vc.Address != "" {
+		return fmt.Sprintf("https://%v/sdk", vc.Address)
+	}
 	return fmt.Sprintf("https://%v/sdk", vc.Credentials.IP)
 }
 